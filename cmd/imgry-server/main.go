@@ -16,6 +16,7 @@ import (
 var (
 	flags    = flag.NewFlagSet("imgry", flag.ExitOnError)
 	confFile = flags.String("config", "", "path to config file")
+	isWorker = flags.Bool("worker", false, "run as an engine worker of the server (internal)")
 )
 
 func main() {
@@ -27,6 +28,13 @@ func main() {
 		log.Fatal(err)
 	}
 
+	if *isWorker {
+		if err := server.RunWorker(conf); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	srv := server.New(conf)
 	if err := srv.Configure(); err != nil {
 		log.Fatal(err)
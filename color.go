@@ -0,0 +1,105 @@
+package imgry
+
+import (
+	"fmt"
+	"image/color"
+	"strconv"
+	"strings"
+)
+
+var (
+	Transparent = color.NRGBA{}
+	White       = color.NRGBA{0xff, 0xff, 0xff, 0xff}
+)
+
+// ParseColor parses a color given as hex, with or without a leading #
+// (rgb, rrggbb or rrggbbaa), as rgb(r,g,b) or rgba(r,g,b,a) with an alpha
+// from 0 to 1, or as "transparent".
+func ParseColor(s string) (color.NRGBA, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+
+	switch {
+	case s == "transparent":
+		return Transparent, nil
+	case strings.HasPrefix(s, "rgb"):
+		return parseRGBA(s)
+	}
+
+	hex := strings.TrimPrefix(s, "#")
+	if len(hex) == 3 {
+		hex = string([]byte{hex[0], hex[0], hex[1], hex[1], hex[2], hex[2]})
+	}
+	if len(hex) == 6 {
+		hex += "ff"
+	}
+	if len(hex) != 8 {
+		return color.NRGBA{}, fmt.Errorf("invalid color: %s", s)
+	}
+
+	v, err := strconv.ParseUint(hex, 16, 32)
+	if err != nil {
+		return color.NRGBA{}, fmt.Errorf("invalid color: %s", s)
+	}
+	return color.NRGBA{uint8(v >> 24), uint8(v >> 16), uint8(v >> 8), uint8(v)}, nil
+}
+
+func parseRGBA(s string) (color.NRGBA, error) {
+	var args string
+	switch {
+	case strings.HasPrefix(s, "rgba(") && strings.HasSuffix(s, ")"):
+		args = s[5 : len(s)-1]
+	case strings.HasPrefix(s, "rgb(") && strings.HasSuffix(s, ")"):
+		args = s[4 : len(s)-1]
+	default:
+		return color.NRGBA{}, fmt.Errorf("invalid color: %s", s)
+	}
+
+	parts := strings.Split(args, ",")
+	if len(parts) != 3 && len(parts) != 4 {
+		return color.NRGBA{}, fmt.Errorf("invalid color: %s", s)
+	}
+
+	c := color.NRGBA{A: 0xff}
+	for n, p := range parts {
+		p = strings.TrimSpace(p)
+		if n == 3 {
+			a, err := strconv.ParseFloat(p, 64)
+			if err != nil || a < 0 || a > 1 {
+				return color.NRGBA{}, fmt.Errorf("invalid color: %s", s)
+			}
+			c.A = uint8(round(a * 255))
+			continue
+		}
+		v, err := strconv.ParseUint(p, 10, 8)
+		if err != nil {
+			return color.NRGBA{}, fmt.Errorf("invalid color: %s", s)
+		}
+		switch n {
+		case 0:
+			c.R = uint8(v)
+		case 1:
+			c.G = uint8(v)
+		case 2:
+			c.B = uint8(v)
+		}
+	}
+	return c, nil
+}
+
+// FormatColor returns the color as hex, in the form ParseColor accepts.
+func FormatColor(c color.NRGBA) string {
+	if c.A == 0xff {
+		return fmt.Sprintf("%02x%02x%02x", c.R, c.G, c.B)
+	}
+	return fmt.Sprintf("%02x%02x%02x%02x", c.R, c.G, c.B, c.A)
+}
+
+// FormatHasAlpha reports whether images of format can be transparent.
+func FormatHasAlpha(format string) bool {
+	switch strings.ToLower(format) {
+	case "jpg", "jpeg", "bmp", "bm":
+		return false
+	default:
+		return true
+	}
+}
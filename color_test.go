@@ -0,0 +1,38 @@
+package imgry
+
+import (
+	"image/color"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseColor(t *testing.T) {
+	tests := []struct {
+		in  string
+		out color.NRGBA
+	}{
+		{"ff0000", color.NRGBA{0xff, 0, 0, 0xff}},
+		{"#FF0000", color.NRGBA{0xff, 0, 0, 0xff}},
+		{"f00", color.NRGBA{0xff, 0, 0, 0xff}},
+		{"00ff0080", color.NRGBA{0, 0xff, 0, 0x80}},
+		{"rgb(0,0,255)", color.NRGBA{0, 0, 0xff, 0xff}},
+		{"rgba(0, 0, 255, 0.5)", color.NRGBA{0, 0, 0xff, 0x80}},
+		{"transparent", Transparent},
+	}
+
+	for _, tt := range tests {
+		c, err := ParseColor(tt.in)
+		assert.NoError(t, err, tt.in)
+		assert.Equal(t, tt.out, c, tt.in)
+
+		c, err = ParseColor(FormatColor(c))
+		assert.NoError(t, err, tt.in)
+		assert.Equal(t, tt.out, c, tt.in)
+	}
+
+	for _, in := range []string{"", "red", "ff00", "gggggg", "rgb(256,0,0)", "rgba(0,0,0,2)", "rgb(0,0)"} {
+		_, err := ParseColor(in)
+		assert.Error(t, err, in)
+	}
+}
@@ -0,0 +1,53 @@
+package imgry
+
+import (
+	"image"
+	"image/color"
+	"math"
+)
+
+// Max number of samples taken along each side of an image when looking
+// for its focal point.
+const focalSamples = 64
+
+// AutoFocalPoint returns the focal point of m, as percentages, found as
+// the center of mass of its edges. Large images are sampled, but handing it
+// a downscaled copy is a lot cheaper.
+func AutoFocalPoint(m image.Image) *FloatPoint {
+	b := m.Bounds()
+	w, h := min(b.Dx(), focalSamples), min(b.Dy(), focalSamples)
+	if w < 3 || h < 3 {
+		return NewFloatPoint(0.5, 0.5)
+	}
+
+	// Luminance of the sampled pixels
+	lum := make([]float64, w*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			px := b.Min.X + x*b.Dx()/w
+			py := b.Min.Y + y*b.Dy()/h
+			lum[y*w+x] = float64(color.GrayModel.Convert(m.At(px, py)).(color.Gray).Y)
+		}
+	}
+
+	// Weight every inner sample by its gradient
+	var sum, sumX, sumY float64
+	for y := 1; y < h-1; y++ {
+		for x := 1; x < w-1; x++ {
+			dx := lum[y*w+x+1] - lum[y*w+x-1]
+			dy := lum[(y+1)*w+x] - lum[(y-1)*w+x]
+			e := math.Abs(dx) + math.Abs(dy)
+			sum += e
+			sumX += e * (float64(x) + 0.5)
+			sumY += e * (float64(y) + 0.5)
+		}
+	}
+	if sum == 0 {
+		return NewFloatPoint(0.5, 0.5)
+	}
+
+	// Rounded so the point is stable across encodings of the same image
+	fx := math.Floor(sumX/sum/float64(w)*100+0.5) / 100
+	fy := math.Floor(sumY/sum/float64(h)*100+0.5) / 100
+	return NewFloatPoint(fx, fy)
+}
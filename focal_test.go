@@ -0,0 +1,31 @@
+package imgry
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAutoFocalPoint(t *testing.T) {
+	// A busy square in the top left of a flat image
+	m := image.NewGray(image.Rect(0, 0, 400, 200))
+	draw.Draw(m, m.Bounds(), image.NewUniform(color.White), image.ZP, draw.Src)
+	for y := 20; y < 60; y++ {
+		for x := 20; x < 60; x++ {
+			if (x/4+y/4)%2 == 0 {
+				m.SetGray(x, y, color.Gray{0})
+			}
+		}
+	}
+
+	fp := AutoFocalPoint(m)
+	assert.InDelta(t, 0.1, fp.X, 0.05)
+	assert.InDelta(t, 0.2, fp.Y, 0.05)
+
+	// Nothing stands out in a flat image
+	flat := image.NewGray(image.Rect(0, 0, 100, 100))
+	assert.Equal(t, NewFloatPoint(0.5, 0.5), AutoFocalPoint(flat))
+}
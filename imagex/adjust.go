@@ -0,0 +1,176 @@
+package imagex
+
+import (
+	"image"
+	"math"
+
+	"github.com/pressly/imgry"
+	"golang.org/x/image/draw"
+)
+
+// adjust returns m with the adjustment filters of the sizing applied, in
+// the order they're listed in imgry.Sizing.
+func adjust(m image.Image, sz *imgry.Sizing) image.Image {
+	if !sz.Adjusts() {
+		return m
+	}
+
+	b := m.Bounds()
+	if sz.Grayscale || sz.Brightness != 0 || sz.Contrast != 0 || sz.Saturation != 0 || sz.Gamma != 0 {
+		dst := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+		draw.Draw(dst, dst.Bounds(), m, b.Min, draw.Src)
+		adjustColors(dst, sz)
+		m = dst
+		b = m.Bounds()
+	}
+
+	if sz.Blur != 0 || sz.Sharpen != 0 {
+		src := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+		draw.Draw(src, src.Bounds(), m, b.Min, draw.Src)
+		if sz.Blur != 0 {
+			src = blur(src, 0, sz.Blur)
+		}
+		if sz.Sharpen != 0 {
+			sharpen(src, blur(src, 0, sz.Sharpen), 1, 0)
+		}
+		m = src
+	}
+	return m
+}
+
+// adjustColors changes the colors of m in place, leaving its alpha.
+func adjustColors(m *image.NRGBA, sz *imgry.Sizing) {
+	// Brightness, contrast and gamma change each channel on its own, so
+	// they're looked up once per value. Brightness and contrast are done
+	// the way ImageMagick does them.
+	bri := float64(sz.Brightness)
+	slope := math.Max(math.Tan(math.Pi*(float64(sz.Contrast)/100+1)/4), 0)
+	intercept := bri/100 + (100-bri)/200*(1-slope)
+
+	var curve, gamma [256]uint8
+	for v := range curve {
+		curve[v] = clamp8((slope*float64(v)/255 + intercept) * 255)
+		gamma[v] = uint8(v)
+		if sz.Gamma != 0 {
+			gamma[v] = clamp8(math.Pow(float64(v)/255, 1/sz.Gamma) * 255)
+		}
+	}
+	sat := 1 + float64(sz.Saturation)/100
+
+	for i := 0; i+4 <= len(m.Pix); i += 4 {
+		px := m.Pix[i : i+3 : i+3]
+		if sz.Grayscale {
+			y := clamp8(luma(px))
+			px[0], px[1], px[2] = y, y, y
+		}
+		for c := range px {
+			px[c] = curve[px[c]]
+		}
+		if sat != 1 {
+			y := luma(px)
+			for c := range px {
+				px[c] = clamp8(y + (float64(px[c])-y)*sat)
+			}
+		}
+		for c := range px {
+			px[c] = gamma[px[c]]
+		}
+	}
+}
+
+// unsharp returns m sharpened by the unsharp mask.
+func unsharp(m image.Image, usm *imgry.UnsharpMask) image.Image {
+	b := m.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(dst, dst.Bounds(), m, b.Min, draw.Src)
+	sharpen(dst, blur(dst, int(math.Ceil(usm.Radius)), usm.Sigma), usm.Amount, usm.Threshold)
+	return dst
+}
+
+// blur returns a copy of m with a gaussian blur of sigma, done in two
+// passes of a one dimensional kernel reaching radius pixels, or three
+// sigmas when radius is 0.
+func blur(m *image.RGBA, radius int, sigma float64) *image.RGBA {
+	if radius <= 0 {
+		radius = int(math.Ceil(sigma * 3))
+	}
+	kernel := make([]float64, 2*radius+1)
+	var sum float64
+	for k := range kernel {
+		d := float64(k - radius)
+		kernel[k] = math.Exp(-d * d / (2 * sigma * sigma))
+		sum += kernel[k]
+	}
+	for k := range kernel {
+		kernel[k] /= sum
+	}
+
+	// Along the rows, then down the columns
+	w, h := m.Rect.Dx(), m.Rect.Dy()
+	tmp := image.NewRGBA(m.Rect)
+	dst := image.NewRGBA(m.Rect)
+	convolve(tmp.Pix, m.Pix, kernel, h, w, m.Stride, 4)
+	convolve(dst.Pix, tmp.Pix, kernel, w, h, 4, m.Stride)
+	return dst
+}
+
+// convolve runs kernel along the n lines of src, which start line bytes
+// apart and are length pixels step bytes apart, clamping at their ends.
+func convolve(dst, src []uint8, kernel []float64, n, length, line, step int) {
+	radius := len(kernel) / 2
+	for l := 0; l < n; l++ {
+		for p := 0; p < length; p++ {
+			var acc [4]float64
+			for k, kv := range kernel {
+				q := p + k - radius
+				if q < 0 {
+					q = 0
+				} else if q >= length {
+					q = length - 1
+				}
+				o := l*line + q*step
+				for c := 0; c < 4; c++ {
+					acc[c] += kv * float64(src[o+c])
+				}
+			}
+			o := l*line + p*step
+			for c := 0; c < 4; c++ {
+				dst[o+c] = clamp8(acc[c])
+			}
+		}
+	}
+}
+
+// sharpen sharpens m in place by adding back amount times the details
+// that blurred takes away from it, where they're over threshold.
+func sharpen(m, blurred *image.RGBA, amount, threshold float64) {
+	for i := 0; i+4 <= len(m.Pix); i += 4 {
+		a := m.Pix[i+3]
+		for c := 0; c < 3; c++ {
+			d := float64(m.Pix[i+c]) - float64(blurred.Pix[i+c])
+			if math.Abs(d) < threshold*255 {
+				continue
+			}
+			v := clamp8(float64(m.Pix[i+c]) + amount*d)
+			if v > a {
+				v = a // stays premultiplied
+			}
+			m.Pix[i+c] = v
+		}
+	}
+}
+
+func luma(px []uint8) float64 {
+	return 0.2126*float64(px[0]) + 0.7152*float64(px[1]) + 0.0722*float64(px[2])
+}
+
+func clamp8(v float64) uint8 {
+	switch {
+	case v <= 0:
+		return 0
+	case v >= 255:
+		return 255
+	default:
+		return uint8(v + 0.5)
+	}
+}
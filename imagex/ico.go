@@ -0,0 +1,238 @@
+package imagex
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"io/ioutil"
+)
+
+// A minimal ICO codec. Icons are decoded from their largest entry, which may
+// either be an embedded PNG or a BMP DIB with an AND mask. Icons are always
+// encoded as a single embedded PNG entry.
+
+var (
+	errInvalidICO     = errors.New("imagex: invalid ico image")
+	errUnsupportedICO = errors.New("imagex: unsupported ico image")
+
+	pngHeader = []byte("\x89PNG\r\n\x1a\n")
+)
+
+const (
+	icoHeaderLen = 6
+	icoEntryLen  = 16
+	dibHeaderLen = 40
+)
+
+type icoEntry struct {
+	width, height int
+	bpp           int
+	size, offset  int
+}
+
+func decodeICO(r io.Reader) (image.Image, error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	e, err := bestICOEntry(b)
+	if err != nil {
+		return nil, err
+	}
+	if e.offset+e.size > len(b) {
+		return nil, errInvalidICO
+	}
+	data := b[e.offset : e.offset+e.size]
+
+	if bytes.HasPrefix(data, pngHeader) {
+		return png.Decode(bytes.NewReader(data))
+	}
+	return decodeDIB(data)
+}
+
+func decodeICOConfig(r io.Reader) (image.Config, error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return image.Config{}, err
+	}
+	e, err := bestICOEntry(b)
+	if err != nil {
+		return image.Config{}, err
+	}
+	return image.Config{ColorModel: color.NRGBAModel, Width: e.width, Height: e.height}, nil
+}
+
+// bestICOEntry returns the largest entry of the icon directory, using the
+// bits per pixel to break ties.
+func bestICOEntry(b []byte) (*icoEntry, error) {
+	if len(b) < icoHeaderLen {
+		return nil, errInvalidICO
+	}
+	le := binary.LittleEndian
+	if le.Uint16(b[0:2]) != 0 || le.Uint16(b[2:4]) != 1 {
+		return nil, errInvalidICO
+	}
+	count := int(le.Uint16(b[4:6]))
+	if count == 0 || len(b) < icoHeaderLen+count*icoEntryLen {
+		return nil, errInvalidICO
+	}
+
+	var best *icoEntry
+	for n := 0; n < count; n++ {
+		d := b[icoHeaderLen+n*icoEntryLen:]
+		e := &icoEntry{
+			width:  int(d[0]),
+			height: int(d[1]),
+			bpp:    int(le.Uint16(d[6:8])),
+			size:   int(le.Uint32(d[8:12])),
+			offset: int(le.Uint32(d[12:16])),
+		}
+		// A zero dimension means 256 pixels
+		if e.width == 0 {
+			e.width = 256
+		}
+		if e.height == 0 {
+			e.height = 256
+		}
+		if best == nil || e.width*e.height > best.width*best.height ||
+			(e.width*e.height == best.width*best.height && e.bpp > best.bpp) {
+			best = e
+		}
+	}
+	return best, nil
+}
+
+// decodeDIB decodes an uncompressed icon bitmap. The height in the header
+// covers both the XOR bitmap and the AND mask that follows it.
+func decodeDIB(b []byte) (image.Image, error) {
+	if len(b) < dibHeaderLen {
+		return nil, errInvalidICO
+	}
+	le := binary.LittleEndian
+	headerLen := int(le.Uint32(b[0:4]))
+	w := int(int32(le.Uint32(b[4:8])))
+	h := int(int32(le.Uint32(b[8:12]))) / 2
+	bpp := int(le.Uint16(b[14:16]))
+	compression := le.Uint32(b[16:20])
+	colorsUsed := int(le.Uint32(b[32:36]))
+
+	if headerLen < dibHeaderLen || w <= 0 || h <= 0 || compression != 0 {
+		return nil, errUnsupportedICO
+	}
+
+	var pal color.Palette
+	offset := headerLen
+	switch bpp {
+	case 1, 4, 8:
+		if colorsUsed == 0 {
+			colorsUsed = 1 << uint(bpp)
+		}
+		if len(b) < offset+colorsUsed*4 {
+			return nil, errInvalidICO
+		}
+		pal = make(color.Palette, colorsUsed)
+		for n := range pal {
+			c := b[offset+n*4:]
+			pal[n] = color.NRGBA{c[2], c[1], c[0], 0xff}
+		}
+		offset += colorsUsed * 4
+	case 24, 32:
+	default:
+		return nil, errUnsupportedICO
+	}
+
+	stride := ((w*bpp + 31) / 32) * 4
+	maskStride := ((w + 31) / 32) * 4
+	if len(b) < offset+stride*h {
+		return nil, errInvalidICO
+	}
+	xor := b[offset : offset+stride*h]
+
+	// Older icons have no mask, in which case everything is opaque
+	var mask []byte
+	if len(b) >= offset+stride*h+maskStride*h {
+		mask = b[offset+stride*h : offset+stride*h+maskStride*h]
+	}
+
+	m := image.NewNRGBA(image.Rect(0, 0, w, h))
+	hasAlpha := false
+
+	// Rows are stored bottom-up
+	for y := 0; y < h; y++ {
+		row := xor[(h-1-y)*stride:]
+		for x := 0; x < w; x++ {
+			var c color.NRGBA
+			switch bpp {
+			case 1, 4, 8:
+				bit := x * bpp
+				idx := int(row[bit/8]>>uint(8-bpp-bit%8)) & (1<<uint(bpp) - 1)
+				if idx < len(pal) {
+					c = pal[idx].(color.NRGBA)
+				}
+			case 24:
+				c = color.NRGBA{row[x*3+2], row[x*3+1], row[x*3], 0xff}
+			case 32:
+				c = color.NRGBA{row[x*4+2], row[x*4+1], row[x*4], row[x*4+3]}
+				if c.A != 0 {
+					hasAlpha = true
+				}
+			}
+			m.SetNRGBA(x, y, c)
+		}
+	}
+
+	// 32 bit icons carry their own alpha channel, the mask is only used for
+	// the ones that don't.
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			p := m.PixOffset(x, y)
+			if bpp == 32 && !hasAlpha {
+				m.Pix[p+3] = 0xff
+			}
+			if mask != nil && (bpp != 32 || !hasAlpha) {
+				row := mask[(h-1-y)*maskStride:]
+				if row[x/8]&(0x80>>uint(x%8)) != 0 {
+					m.Pix[p+3] = 0
+				}
+			}
+		}
+	}
+
+	return m, nil
+}
+
+func encodeICO(w io.Writer, m image.Image) error {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, m); err != nil {
+		return err
+	}
+
+	b := m.Bounds()
+	dim := func(n int) byte {
+		if n >= 256 {
+			return 0
+		}
+		return byte(n)
+	}
+
+	le := binary.LittleEndian
+	hdr := make([]byte, icoHeaderLen+icoEntryLen)
+	le.PutUint16(hdr[2:4], 1) // type: icon
+	le.PutUint16(hdr[4:6], 1) // number of entries
+	hdr[6] = dim(b.Dx())
+	hdr[7] = dim(b.Dy())
+	le.PutUint16(hdr[10:12], 1)  // color planes
+	le.PutUint16(hdr[12:14], 32) // bits per pixel
+	le.PutUint32(hdr[14:18], uint32(buf.Len()))
+	le.PutUint32(hdr[18:22], uint32(len(hdr)))
+
+	if _, err := w.Write(hdr); err != nil {
+		return err
+	}
+	_, err := buf.WriteTo(w)
+	return err
+}
@@ -0,0 +1,813 @@
+package imagex
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"math"
+	"runtime"
+	"strings"
+
+	"github.com/pressly/imgry"
+	"golang.org/x/image/bmp"
+	"golang.org/x/image/draw"
+)
+
+var (
+	ErrEngineReleased    = errors.New("imagex: engine has been released.")
+	ErrUnsupportedFormat = errors.New("imagex: unsupported image format")
+	ErrUnsupportedText   = errors.New("imagex: text is not supported")
+)
+
+var errInvalidGIF = errors.New("imagex: invalid gif image")
+
+func init() {
+	imgry.RegisterEngine("imagex", func() imgry.Engine {
+		return Engine{}
+	})
+}
+
+const (
+	// Quality used for lossy encoders when the sizing doesn't ask for one,
+	// this matches the ImageMagick default.
+	defaultQuality = 92
+)
+
+var (
+	// Mitchell-Netravali cubic filter (B=1/3, C=1/3), used when enlarging
+	mitchellFilter = &draw.Kernel{Support: 2, At: mitchell}
+
+	// 3-lobed lanczos filter, used when shrinking
+	lanczosFilter = &draw.Kernel{Support: 3, At: lanczos3}
+
+	// The filters of imgry.ResampleFilters
+	resampleFilters = map[string]draw.Scaler{
+		"lanczos":  lanczosFilter,
+		"mitchell": mitchellFilter,
+		"catrom":   draw.CatmullRom,
+		"point":    draw.NearestNeighbor,
+		"box":      &draw.Kernel{Support: 0.5, At: func(float64) float64 { return 1 }},
+		"triangle": draw.BiLinear,
+	}
+)
+
+func init() {
+	// Manually register the ICO format as it has no magic string and 0010 is a
+	// terrible thing to sniff for. This init is run after the imports' inits in
+	// this package. So GIF, JPEG, PNG, BMP will be init and registered first.
+	// This means always leave the image imports above.
+	image.RegisterFormat("ico", "\x00\x00\x01\x00", decodeICO, decodeICOConfig)
+}
+
+// Engine is a pure-Go image engine built on the standard library image
+// packages and golang.org/x/image. It does not require cgo or ImageMagick.
+type Engine struct{}
+
+func (ng Engine) Version() string {
+	return fmt.Sprintf("imagex (%s)", runtime.Version())
+}
+
+func (ng Engine) Initialize(tmpDir string) error {
+	// imagex keeps everything in memory, there is nothing to setup
+	return nil
+}
+
+func (ng Engine) Terminate() {}
+
+func (ng Engine) Formats() []string {
+	return append([]string(nil), outputFormats...)
+}
+
+func (ng Engine) LoadFile(filename string, srcFormat ...string) (imgry.Image, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return ng.LoadBlob(context.Background(), b, srcFormat...)
+}
+
+func (ng Engine) LoadBlob(ctx context.Context, b []byte, srcFormat ...string) (imgry.Image, error) {
+	if len(b) == 0 {
+		return nil, imgry.ErrInvalidImageData
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	// The decoders sniff the format by its magic string, the hint is only
+	// used for formats without one.
+	var format string
+	if len(srcFormat) > 0 {
+		format = normalizeFormat(srcFormat[0])
+	}
+	if format != "ico" {
+		_, f, err := image.DecodeConfig(bytes.NewReader(b))
+		if err != nil {
+			return nil, imgry.ErrInvalidImageData
+		}
+		format = normalizeFormat(f)
+	}
+
+	im := &Image{format: format, loopCount: -1}
+
+	switch format {
+	case "gif":
+		g, err := gif.DecodeAll(bytes.NewReader(b))
+		if err != nil {
+			return nil, imgry.ErrInvalidImageData
+		}
+		im.frames = coalesce(g)
+		im.delays = g.Delay
+		im.loopCount = g.LoopCount
+		if p, ok := g.Config.ColorModel.(color.Palette); ok {
+			im.palette = p
+		} else if len(g.Image) > 0 {
+			im.palette = g.Image[0].Palette
+		}
+
+	case "ico":
+		m, err := decodeICO(bytes.NewReader(b))
+		if err != nil {
+			return nil, imgry.ErrInvalidImageData
+		}
+		im.frames = []image.Image{m}
+
+	default:
+		m, _, err := image.Decode(bytes.NewReader(b))
+		if err != nil {
+			return nil, imgry.ErrInvalidImageData
+		}
+		im.frames = []image.Image{m}
+		if format == "jpg" {
+			im.orientation = jpegOrientation(b)
+		}
+	}
+
+	if len(im.frames) == 0 {
+		return nil, imgry.ErrInvalidImageData
+	}
+
+	// Nothing has changed yet, so the source blob is still our data
+	if err := im.sync(); err != nil {
+		return nil, err
+	}
+	im.data = b
+
+	return im, nil
+}
+
+func (ng Engine) GetImageInfo(b []byte, srcFormat ...string) (*imgry.ImageInfo, error) {
+	if len(b) == 0 {
+		return nil, imgry.ErrInvalidImageData
+	}
+
+	var cfg image.Config
+	var format string
+	var err error
+
+	if len(srcFormat) > 0 && normalizeFormat(srcFormat[0]) == "ico" {
+		cfg, err = decodeICOConfig(bytes.NewReader(b))
+		format = "ico"
+	} else {
+		cfg, format, err = image.DecodeConfig(bytes.NewReader(b))
+	}
+	if err != nil {
+		return nil, imgry.ErrInvalidImageData
+	}
+
+	// The dimensions the image is displayed with
+	w, h := cfg.Width, cfg.Height
+	if format == "jpeg" && swapsSides(jpegOrientation(b)) {
+		w, h = h, w
+	}
+	ar := float64(int(float64(w)/float64(h)*10000)) / 10000
+
+	frames := 1
+	if format == "gif" {
+		if frames, err = gifFrames(b); err != nil {
+			return nil, imgry.ErrInvalidImageData
+		}
+	}
+
+	imfo := &imgry.ImageInfo{
+		Format: normalizeFormat(format), Width: w, Height: h,
+		AspectRatio: ar, ContentLength: len(b),
+		Frames: frames,
+	}
+
+	return imfo, nil
+}
+
+type Image struct {
+	frames      []image.Image
+	delays      []int
+	loopCount   int
+	palette     color.Palette
+	quality     int
+	orientation int // EXIF orientation of the frames, 0 or 1 when upright
+
+	data   []byte // encoded lazily, see Data()
+	width  int
+	height int
+	format string
+}
+
+func (i *Image) Data() []byte {
+	if i.data == nil && !i.Released() {
+		var buf bytes.Buffer
+		if err := i.encode(&buf); err != nil {
+			return nil
+		}
+		i.data = buf.Bytes()
+	}
+	return i.data
+}
+
+func (i *Image) Width() int {
+	return i.width
+}
+
+func (i *Image) Height() int {
+	return i.height
+}
+
+func (i *Image) Format() string {
+	return i.format
+}
+
+func (i *Image) SetFormat(format string) error {
+	if i.Released() {
+		return ErrEngineReleased
+	}
+	format = normalizeFormat(format)
+	if !supportedFormat(format) {
+		return ErrUnsupportedFormat
+	}
+	i.format = format
+	if err := i.sync(); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (i *Image) Released() bool {
+	return i.frames == nil
+}
+
+func (i *Image) Release() {
+	i.frames = nil
+	i.delays = nil
+	i.palette = nil
+}
+
+func (i *Image) Clone() imgry.Image {
+	i2 := &Image{}
+	i2.data = i.data
+	i2.width = i.width
+	i2.height = i.height
+	i2.format = i.format
+	i2.loopCount = i.loopCount
+	i2.palette = i.palette
+	i2.quality = i.quality
+	i2.orientation = i.orientation
+	if i.frames != nil {
+		// Frames are never modified in place, so they can be shared
+		i2.frames = append([]image.Image{}, i.frames...)
+		i2.delays = append([]int{}, i.delays...)
+	}
+	return i2
+}
+
+// SizeIt sizes the image in place. The context is checked between each
+// frame and step of the sizing, and its error returned once it is done.
+func (i *Image) SizeIt(ctx context.Context, sz *imgry.Sizing) error {
+	if i.Released() {
+		return ErrEngineReleased
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	// Turn the frames upright first, the EXIF orientation isn't kept
+	if i.orientation > 1 {
+		if !sz.KeepOrientation {
+			frames := make([]image.Image, len(i.frames))
+			for n, frame := range i.frames {
+				frames[n] = orient(frame, i.orientation)
+			}
+			i.frames = frames
+		}
+		i.orientation = 1
+		if err := i.sync(); err != nil {
+			return err
+		}
+	}
+
+	if err := i.sizeFrames(ctx, sz); err != nil {
+		return err
+	}
+
+	if sz.Format == imgry.FormatAuto {
+		i.format = i.autoFormat()
+	} else if sz.Format != "" {
+		format := normalizeFormat(sz.Format)
+		if !supportedFormat(format) {
+			return ErrUnsupportedFormat
+		}
+		i.format = format
+	}
+
+	// What's transparent goes onto the background in formats without alpha
+	if !imgry.FormatHasAlpha(i.format) {
+		fill := sz.FillColor(i.format)
+		for n, m := range i.frames {
+			i.frames[n] = flattenAlpha(m, fill)
+		}
+	}
+
+	if sz.Quality > 0 {
+		i.quality = sz.Quality
+	}
+
+	if sz.Flatten {
+		i.frames = i.frames[:1]
+	}
+
+	if err := i.sync(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (i *Image) sizeFrames(ctx context.Context, sz *imgry.Sizing) error {
+	// Shortcut if there is nothing to size
+	if !sz.Transforms() {
+		return nil
+	}
+
+	// There's no font rendering here
+	if sz.Text != nil {
+		return ErrUnsupportedText
+	}
+
+	b := i.frames[0].Bounds()
+	sz.ResolveDPR(imgry.NewRect(b.Dx(), b.Dy()))
+
+	// Canvases are transparent, padding and the corners left by a rotation
+	// are filled as the sizing says
+	format := i.format
+	if sz.Format != "" {
+		format = normalizeFormat(sz.Format)
+	}
+	fill := sz.CanvasFill(format)
+	rotFill := sz.FillColor(format)
+
+	var wm *overlay
+	if sz.Watermark != nil {
+		var err error
+		if wm, err = newOverlay(sz.Watermark); err != nil {
+			return err
+		}
+	}
+
+	// Frames are sized into a new slice so an aborted sizing leaves the
+	// image untouched.
+	frames := append([]image.Image{}, i.frames...)
+	for n, frame := range frames {
+		m, err := sizeFrame(ctx, frame, sz, fill, rotFill)
+		if err != nil {
+			return err
+		}
+		if wm != nil {
+			m = wm.drawOn(m, sz)
+		}
+		frames[n] = m
+
+		if sz.Flatten {
+			break
+		}
+	}
+	i.frames = frames
+
+	return nil
+}
+
+func sizeFrame(ctx context.Context, m image.Image, sz *imgry.Sizing, fill, rotFill color.NRGBA) (image.Image, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	// Turn and mirror the frame, before it's cropped
+	if sz.Rotate != 0 {
+		m = rotate(m, sz.Rotate, rotFill)
+	}
+	if strings.Contains(sz.Flip, "h") {
+		m = orient(m, 2)
+	}
+	if strings.Contains(sz.Flip, "v") {
+		m = orient(m, 4)
+	}
+
+	b := m.Bounds()
+	srcSize := imgry.NewRect(b.Dx(), b.Dy())
+
+	// Initial crop of the source image
+	cropBox, cropOrigin, err := sz.CalcCropBox(srcSize)
+	if err != nil {
+		return nil, err
+	}
+	if cropBox != nil && !cropBox.Equal(imgry.ZeroRect) && (cropBox.Width <= 0 || cropBox.Height <= 0) {
+		return nil, imgry.ErrEmptyCropBox
+	}
+
+	if cropBox != nil && cropOrigin != nil && !cropBox.Equal(imgry.ZeroRect) {
+		m = crop(m, cropBox, cropOrigin)
+		b = m.Bounds()
+		srcSize = imgry.NewRect(b.Dx(), b.Dy())
+	}
+
+	// Find the focal point of the auto gravity on the first frame
+	if sz.NeedsFocalPoint() {
+		sz.FocalPoint = imgry.AutoFocalPoint(m)
+	}
+
+	// Resize the image
+	resizeRect, cropBox, cropOrigin := sz.CalcResizeRect(srcSize)
+	if resizeRect != nil && !resizeRect.Equal(imgry.ZeroRect) && !resizeRect.Equal(srcSize) {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		resizeFilter, ok := resampleFilters[sz.Filter]
+		if !ok {
+			if resizeRect.Width > srcSize.Width {
+				resizeFilter = mitchellFilter
+			} else {
+				resizeFilter = lanczosFilter
+			}
+		}
+
+		dst := image.NewRGBA(image.Rect(0, 0, resizeRect.Width, resizeRect.Height))
+		resizeFilter.Scale(dst, dst.Bounds(), m, m.Bounds(), draw.Src, nil)
+		m = dst
+	}
+
+	// Sharpen what the resize softened
+	if usm := sz.Unsharp; usm != nil {
+		m = unsharp(m, usm)
+	}
+
+	// Perform any final crops from an operation
+	if cropBox != nil && cropOrigin != nil && !cropBox.Equal(imgry.ZeroRect) {
+		m = crop(m, cropBox, cropOrigin)
+	}
+
+	// Adjust the sized frame, before it's put on a canvas
+	m = adjust(m, sz)
+
+	// If we have a canvas we put the image on it, at its gravity.
+	b = m.Bounds()
+	if cs, origin := sz.CalcCanvas(imgry.NewRect(b.Dx(), b.Dy())); cs != nil {
+		canvas := image.NewRGBA(image.Rect(0, 0, cs.Width, cs.Height))
+		if fill != imgry.Transparent {
+			draw.Draw(canvas, canvas.Bounds(), image.NewUniform(fill), image.ZP, draw.Src)
+		}
+
+		r := image.Rect(origin.X, origin.Y, origin.X+b.Dx(), origin.Y+b.Dy())
+		draw.Draw(canvas, r, m, b.Min, draw.Over)
+		m = canvas
+	}
+
+	return m, nil
+}
+
+func (i *Image) WriteToFile(fn string) error {
+	err := ioutil.WriteFile(fn, i.Data(), 0664)
+	return err
+}
+
+func (i *Image) encode(w io.Writer) error {
+	quality := i.quality
+	if quality <= 0 {
+		quality = defaultQuality
+	}
+
+	m := i.frames[0]
+
+	switch i.format {
+	case "jpg":
+		return jpeg.Encode(w, m, &jpeg.Options{Quality: min(quality, 100)})
+	case "png":
+		return png.Encode(w, m)
+	case "gif":
+		return gif.EncodeAll(w, i.gif(i.frames))
+	case "bmp":
+		return bmp.Encode(w, m)
+	case "ico":
+		return encodeICO(w, m)
+	}
+	return ErrUnsupportedFormat
+}
+
+// sync updates the image details from the frames and drops the encoded
+// data, which will be produced again the next time it's needed.
+func (i *Image) sync() error {
+	if i.Released() {
+		return ErrEngineReleased
+	}
+
+	i.data = nil
+
+	b := i.frames[0].Bounds()
+	i.width, i.height = b.Dx(), b.Dy()
+	if swapsSides(i.orientation) {
+		i.width, i.height = i.height, i.width
+	}
+
+	return nil
+}
+
+// gif builds a GIF from the frames, mapping each of them to the source
+// palette (or a web safe one when the source was not a GIF).
+func (i *Image) gif(frames []image.Image) *gif.GIF {
+	p := i.palette
+	if len(p) == 0 {
+		p = append(color.Palette{color.Transparent}, palette.WebSafe...)
+	}
+
+	g := &gif.GIF{LoopCount: i.loopCount}
+	for n, frame := range frames {
+		pm := quantize(frame, p)
+
+		delay := 0
+		if n < len(i.delays) {
+			delay = i.delays[n]
+		}
+
+		g.Image = append(g.Image, pm)
+		g.Delay = append(g.Delay, delay)
+		// Frames are coalesced, so each one replaces the previous
+		g.Disposal = append(g.Disposal, gif.DisposalBackground)
+	}
+	if len(g.Image) == 1 {
+		g.LoopCount = 0
+		g.Disposal = nil
+	}
+	return g
+}
+
+// quantize maps each pixel of m to its closest color in the palette. The
+// lookups are cached on the 6 most significant bits of each channel, which
+// keeps the cache small after resampling has introduced new colors.
+func quantize(m image.Image, p color.Palette) *image.Paletted {
+	b := m.Bounds()
+	pm := image.NewPaletted(image.Rect(0, 0, b.Dx(), b.Dy()), p)
+	cache := make(map[color.RGBA]uint8)
+
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			c := color.RGBAModel.Convert(m.At(b.Min.X+x, b.Min.Y+y)).(color.RGBA)
+			c.R, c.G, c.B, c.A = c.R&0xfc, c.G&0xfc, c.B&0xfc, c.A&0xfc
+			idx, ok := cache[c]
+			if !ok {
+				idx = uint8(p.Index(c))
+				cache[c] = idx
+			}
+			pm.Pix[y*pm.Stride+x] = idx
+		}
+	}
+	return pm
+}
+
+// gifFrames counts the frames of a GIF by walking its blocks, without
+// decoding any of the image data.
+func gifFrames(b []byte) (int, error) {
+	const headerLen = 13
+
+	if len(b) < headerLen {
+		return 0, errInvalidGIF
+	}
+	p := headerLen
+	if b[10]&0x80 != 0 {
+		p += 3 << (uint(b[10]&0x07) + 1) // global color table
+	}
+
+	// skip a sequence of data sub-blocks, ended by an empty one
+	skipSubBlocks := func() bool {
+		for p < len(b) {
+			n := int(b[p])
+			p += n + 1
+			if n == 0 {
+				return true
+			}
+		}
+		return false
+	}
+
+	frames := 0
+	for p < len(b) {
+		switch b[p] {
+		case 0x21: // extension
+			p += 2
+			if !skipSubBlocks() {
+				return 0, errInvalidGIF
+			}
+		case 0x2c: // image descriptor
+			if p+10 > len(b) {
+				return 0, errInvalidGIF
+			}
+			flags := b[p+9]
+			p += 10
+			if flags&0x80 != 0 {
+				p += 3 << (uint(flags&0x07) + 1) // local color table
+			}
+			p++ // LZW minimum code size
+			if !skipSubBlocks() {
+				return 0, errInvalidGIF
+			}
+			frames++
+		case 0x3b: // trailer
+			return frames, nil
+		default:
+			return 0, errInvalidGIF
+		}
+	}
+
+	// Tolerate a missing trailer like most decoders do
+	return frames, nil
+}
+
+// coalesce composes each frame of an animated GIF over the frames before
+// it, returning full sized frames.
+func coalesce(g *gif.GIF) []image.Image {
+	bounds := image.Rect(0, 0, g.Config.Width, g.Config.Height)
+	for _, src := range g.Image {
+		bounds = bounds.Union(src.Bounds())
+	}
+
+	canvas := image.NewRGBA(bounds)
+	frames := make([]image.Image, len(g.Image))
+
+	for n, src := range g.Image {
+		var disposal byte
+		if n < len(g.Disposal) {
+			disposal = g.Disposal[n]
+		}
+
+		var prev *image.RGBA
+		if disposal == gif.DisposalPrevious {
+			prev = cloneRGBA(canvas)
+		}
+
+		draw.Draw(canvas, src.Bounds(), src, src.Bounds().Min, draw.Over)
+		frames[n] = cloneRGBA(canvas)
+
+		switch disposal {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, src.Bounds(), image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			canvas = prev
+		}
+	}
+
+	return frames
+}
+
+// crop returns a copy of the region of m, clipped to the image bounds.
+func crop(m image.Image, size *imgry.Rect, origin *image.Point) image.Image {
+	b := m.Bounds()
+	min := b.Min.Add(*origin)
+	r := image.Rect(min.X, min.Y, min.X+size.Width, min.Y+size.Height).Intersect(b)
+
+	dst := image.NewRGBA(image.Rect(0, 0, r.Dx(), r.Dy()))
+	draw.Draw(dst, dst.Bounds(), m, r.Min, draw.Src)
+	return dst
+}
+
+func cloneRGBA(m *image.RGBA) *image.RGBA {
+	dst := image.NewRGBA(m.Bounds())
+	copy(dst.Pix, m.Pix)
+	return dst
+}
+
+func normalizeFormat(format string) string {
+	format = strings.ToLower(format)
+	switch format {
+	case "jpeg":
+		return "jpg"
+	case "bm":
+		return "bmp"
+	}
+	return format
+}
+
+// flattenAlpha returns m composited onto the color c, or m itself when
+// it's opaque.
+func flattenAlpha(m image.Image, c color.NRGBA) image.Image {
+	if o, ok := m.(interface {
+		Opaque() bool
+	}); ok && o.Opaque() {
+		return m
+	}
+	b := m.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(dst, dst.Bounds(), image.NewUniform(c), image.ZP, draw.Src)
+	draw.Draw(dst, dst.Bounds(), m, b.Min, draw.Over)
+	return dst
+}
+
+// autoFormat picks the format of FormatAuto for the sized image, turning
+// flat graphics into a palette image for a palette PNG. Animations keep
+// their format.
+func (i *Image) autoFormat() string {
+	if len(i.frames) > 1 {
+		return i.format
+	}
+
+	b := i.frames[0].Bounds()
+	m := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(m, m.Bounds(), i.frames[0], b.Min, draw.Src)
+
+	// The colors are only counted up to one over a palette
+	alpha := false
+	index := map[color.NRGBA]uint8{}
+	var pal color.Palette
+	for p := 0; p+4 <= len(m.Pix); p += 4 {
+		c := color.NRGBA{m.Pix[p], m.Pix[p+1], m.Pix[p+2], m.Pix[p+3]}
+		if c.A != 0xff {
+			alpha = true
+		}
+		if _, ok := index[c]; !ok && len(pal) <= imgry.MaxPaletteColors {
+			index[c] = uint8(len(pal))
+			pal = append(pal, c)
+		}
+	}
+
+	format := imgry.AutoFormat(alpha, len(pal))
+	if format == "png" && len(pal) <= imgry.MaxPaletteColors {
+		dst := image.NewPaletted(m.Bounds(), pal)
+		for p := 0; p+4 <= len(m.Pix); p += 4 {
+			dst.Pix[p/4] = index[color.NRGBA{m.Pix[p], m.Pix[p+1], m.Pix[p+2], m.Pix[p+3]}]
+		}
+		i.frames[0] = dst
+	}
+	return format
+}
+
+// outputFormats are the formats imagex encodes
+var outputFormats = []string{"jpg", "png", "gif", "bmp", "ico"}
+
+func supportedFormat(format string) bool {
+	for _, f := range outputFormats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
+
+func mitchell(t float64) float64 {
+	const b, c = 1.0 / 3, 1.0 / 3
+	t = math.Abs(t)
+	switch {
+	case t < 1:
+		return ((12-9*b-6*c)*t*t*t + (-18+12*b+6*c)*t*t + (6 - 2*b)) / 6
+	case t < 2:
+		return ((-b-6*c)*t*t*t + (6*b+30*c)*t*t + (-12*b-48*c)*t + (8*b + 24*c)) / 6
+	}
+	return 0
+}
+
+func lanczos3(t float64) float64 {
+	t = math.Abs(t)
+	if t < 3 {
+		return sinc(t) * sinc(t/3)
+	}
+	return 0
+}
+
+func sinc(t float64) float64 {
+	if t == 0 {
+		return 1
+	}
+	t *= math.Pi
+	return math.Sin(t) / t
+}
+
+// Min function for ints
+func min(first, second int) int {
+	if first < second {
+		return first
+	}
+	return second
+}
@@ -0,0 +1,728 @@
+package imagex
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io/ioutil"
+	"testing"
+
+	"github.com/pressly/imgry"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadBlob(t *testing.T) {
+	tdImage1, err := ioutil.ReadFile("../testdata/image1.jpg")
+	assert.NoError(t, err)
+
+	ng := Engine{}
+	im, err := ng.LoadBlob(context.Background(), tdImage1)
+	assert.NoError(t, err)
+	defer im.Release()
+
+	sz, _ := imgry.NewSizingFromQuery("size=800x")
+	err = im.SizeIt(context.Background(), sz)
+	assert.NoError(t, err)
+
+	im2Path := "/tmp/imagex-image1.jpg"
+	im.WriteToFile(im2Path)
+
+	im2, err := ng.LoadFile(im2Path)
+	assert.NoError(t, err)
+
+	assert.Equal(t, 800, im2.Width())
+	assert.Equal(t, "jpg", im2.Format())
+
+	err = im2.SetFormat("png")
+	assert.NoError(t, err)
+	assert.Equal(t, "png", im2.Format())
+}
+
+func TestDataKeepsSource(t *testing.T) {
+	tdImage, err := ioutil.ReadFile("../testdata/image1.jpg")
+	assert.NoError(t, err)
+
+	ng := Engine{}
+	im, err := ng.LoadBlob(context.Background(), tdImage)
+	assert.NoError(t, err)
+	defer im.Release()
+
+	// Until the image is changed, its data is the source blob
+	assert.Equal(t, 1600, im.Width())
+	assert.Equal(t, tdImage, im.Data())
+
+	sz, _ := imgry.NewSizingFromQuery("size=400x&format=png")
+	err = im.SizeIt(context.Background(), sz)
+	assert.NoError(t, err)
+
+	im2, err := ng.LoadBlob(context.Background(), im.Data())
+	assert.NoError(t, err)
+	defer im2.Release()
+
+	assert.Equal(t, 400, im2.Width())
+	assert.Equal(t, "png", im2.Format())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = ng.LoadBlob(ctx, tdImage)
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestGetImageInfo(t *testing.T) {
+	tdImage1, err := ioutil.ReadFile("../testdata/image1.jpg")
+	assert.NoError(t, err)
+
+	ng := Engine{}
+	imfo, err := ng.GetImageInfo(tdImage1)
+	assert.NoError(t, err)
+
+	assert.Equal(t, imfo.Width, 1600)
+	assert.Equal(t, imfo.Height, 1200)
+	assert.Equal(t, "jpg", imfo.Format)
+	assert.True(t, float64(int(imfo.AspectRatio*1000))/1000 == 1.333)
+	assert.True(t, imfo.ContentLength == 451317)
+	assert.Equal(t, 1, imfo.Frames)
+
+	tdImage2, err := ioutil.ReadFile("../testdata/issue-8.gif")
+	assert.NoError(t, err)
+
+	imfo, err = ng.GetImageInfo(tdImage2)
+	assert.NoError(t, err)
+	assert.Equal(t, 27, imfo.Frames)
+}
+
+func TestLoadFormats(t *testing.T) {
+	tests := []struct {
+		file   string
+		format string
+	}{
+		{"../testdata/gophers.jpg", "jpg"},
+		{"../testdata/gophers-cmyk.jpg", "jpg"},
+		{"../testdata/gophers.png", "png"},
+		{"../testdata/gophers.gif", "gif"},
+		{"../testdata/gophers.bmp", "bmp"},
+		{"../testdata/favicon.ico", "ico"},
+	}
+
+	ng := Engine{}
+	for _, tt := range tests {
+		img, err := ng.LoadFile(tt.file)
+		if !assert.NoError(t, err, tt.file) {
+			continue
+		}
+		assert.Equal(t, tt.format, img.Format(), tt.file)
+		assert.False(t, img.Released())
+
+		sz, _ := imgry.NewSizingFromQuery("size=20x20")
+		err = img.SizeIt(context.Background(), sz)
+		assert.NoError(t, err, tt.file)
+
+		assert.Equal(t, 20, img.Width(), tt.file)
+		assert.Equal(t, 20, img.Height(), tt.file)
+		assert.NotEmpty(t, img.Data(), tt.file)
+
+		img.Release()
+		assert.True(t, img.Released())
+	}
+}
+
+func TestIssue8GIFResize(t *testing.T) {
+	ng := Engine{}
+
+	tests := []struct {
+		query string
+		w, h  int
+	}{
+		{"size=750x", 750, 422},
+		{"size=500x", 500, 282},
+		{"size=200x", 200, 113},
+		{"size=150x", 150, 84},
+	}
+
+	for _, tt := range tests {
+		img, err := ng.LoadFile("../testdata/issue-8.gif")
+		assert.NoError(t, err)
+
+		// Unlike ImageMagick, the frames are coalesced on load so we report
+		// the size of the whole animation rather than the first frame.
+		assert.Equal(t, 817, img.Width())
+		assert.Equal(t, 460, img.Height())
+
+		sz, _ := imgry.NewSizingFromQuery(tt.query)
+		err = img.SizeIt(context.Background(), sz)
+		assert.NoError(t, err)
+
+		assert.Equal(t, tt.w, img.Width(), tt.query)
+		assert.Equal(t, tt.h, img.Height(), tt.query)
+
+		// The animation must survive a resize
+		img2, err := ng.LoadBlob(context.Background(), img.Data())
+		assert.NoError(t, err)
+		assert.True(t, len(img2.(*Image).frames) > 1)
+		img2.Release()
+
+		img.Release()
+	}
+}
+
+func TestOpFitted(t *testing.T) {
+	tests := []struct {
+		file  string
+		query string
+		w, h  int
+	}{
+		{"../testdata/issue-10-p.jpg", "size=200x&canvas=320x200&op=fitted", 320, 200},
+		{"../testdata/issue-10-p.jpg", "size=150x&canvas=200x350&op=fitted", 200, 350},
+		{"../testdata/issue-10-l.jpg", "size=200x&canvas=150x150&op=fitted", 150, 150},
+		{"../testdata/issue-10-l.png", "size=800x&canvas=650x650&op=fitted", 650, 650},
+		{"../testdata/issue-10-p.gif", "size=100x&canvas=200x200&op=fitted", 200, 200},
+		{"../testdata/issue-10-l.jpg", "size=100x&canvas=160x100&op=fitted&dpr=2", 320, 200},
+	}
+
+	ng := Engine{}
+	for _, tt := range tests {
+		img, err := ng.LoadFile(tt.file)
+		assert.NoError(t, err)
+
+		sz, _ := imgry.NewSizingFromQuery(tt.query)
+		err = img.SizeIt(context.Background(), sz)
+		assert.NoError(t, err)
+
+		assert.Equal(t, tt.w, img.Width(), tt.query)
+		assert.Equal(t, tt.h, img.Height(), tt.query)
+
+		img.Release()
+	}
+}
+
+func TestOpCoverAndCropBox(t *testing.T) {
+	ng := Engine{}
+
+	img, err := ng.LoadFile("../testdata/issue-25.jpg")
+	assert.NoError(t, err)
+
+	assert.Equal(t, 1600, img.Width())
+	assert.Equal(t, 480, img.Height())
+
+	sz, _ := imgry.NewSizingFromQuery("format=png&size=750x922&op=cover&cb=0.1,0.1,0.9,0.9")
+	err = img.SizeIt(context.Background(), sz)
+	assert.NoError(t, err)
+
+	assert.Equal(t, 750, img.Width())
+	assert.Equal(t, 920, img.Height())
+	assert.Equal(t, "png", img.Format())
+
+	img.Release()
+}
+
+func TestOpPad(t *testing.T) {
+	ng := Engine{}
+
+	tests := []struct {
+		query string
+		x, y  int
+		fill  color.NRGBA
+	}{
+		{"size=400x400&op=pad&bg=ff0000&gravity=n", 200, 399, color.NRGBA{0xff, 0, 0, 0xff}},
+		{"size=400x400&op=pad&gravity=s", 200, 0, imgry.White},
+		{"size=400x400&op=pad&format=png", 200, 0, imgry.Transparent},
+	}
+
+	for _, tt := range tests {
+		img, err := ng.LoadFile("../testdata/issue-25.jpg")
+		assert.NoError(t, err)
+
+		sz, _ := imgry.NewSizingFromQuery(tt.query)
+		err = img.SizeIt(context.Background(), sz)
+		assert.NoError(t, err, tt.query)
+
+		assert.Equal(t, 400, img.Width(), tt.query)
+		assert.Equal(t, 400, img.Height(), tt.query)
+
+		m := img.(*Image).frames[0]
+		assert.Equal(t, tt.fill, color.NRGBAModel.Convert(m.At(tt.x, tt.y)), tt.query)
+
+		img.Release()
+	}
+}
+
+func TestGravityAuto(t *testing.T) {
+	ng := Engine{}
+
+	img, err := ng.LoadFile("../testdata/issue-25.jpg")
+	assert.NoError(t, err)
+	defer img.Release()
+
+	sz, _ := imgry.NewSizingFromQuery("size=300x300&op=cover&gravity=auto")
+	err = img.SizeIt(context.Background(), sz)
+	assert.NoError(t, err)
+
+	assert.Equal(t, 300, img.Width())
+	assert.Equal(t, 300, img.Height())
+
+	// The engine found the focal point the crop is centered on
+	if assert.NotNil(t, sz.FocalPoint) {
+		assert.True(t, sz.FocalPoint.X >= 0 && sz.FocalPoint.X <= 1)
+		assert.True(t, sz.FocalPoint.Y >= 0 && sz.FocalPoint.Y <= 1)
+	}
+}
+
+func TestOpSmart(t *testing.T) {
+	ng := Engine{}
+
+	img, err := ng.LoadFile("../testdata/issue-10-l.jpg")
+	assert.NoError(t, err)
+	defer img.Release()
+
+	sz, _ := imgry.NewSizingFromQuery("size=100x100&op=smart")
+	img2 := img.Clone()
+	defer img2.Release()
+	err = img2.SizeIt(context.Background(), sz)
+	assert.NoError(t, err)
+
+	assert.Equal(t, 100, img2.Width())
+	assert.Equal(t, 100, img2.Height())
+
+	// Sizing again with the focal point found gives the same crop
+	fp := sz.FocalPoint
+	if assert.NotNil(t, fp) {
+		sz2, _ := imgry.NewSizingFromQuery("size=100x100&op=smart&fp=" + fp.ToString())
+		assert.False(t, sz2.NeedsFocalPoint())
+		err = img.SizeIt(context.Background(), sz2)
+		assert.NoError(t, err)
+		assert.Equal(t, img2.(*Image).frames[0], img.(*Image).frames[0])
+	}
+}
+
+// The orientation fixture is stored 80x40, red then blue, and turned 90°
+// clockwise by its EXIF, so it loads as 40x80 with red on top.
+const orientedFixture = "../testdata/orientation-6.jpg"
+
+func sizing(query string) *imgry.Sizing {
+	sz, _ := imgry.NewSizingFromQuery(query)
+	return sz
+}
+
+// sizeOriented loads the orientation fixture and sizes it by sz, the
+// caller releases the image.
+func sizeOriented(t *testing.T, sz *imgry.Sizing) imgry.Image {
+	img, err := Engine{}.LoadFile(orientedFixture)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assert.NoError(t, img.SizeIt(context.Background(), sz))
+	return img
+}
+
+// rgbAt returns the 8-bit color at x,y of the first frame.
+func rgbAt(img imgry.Image, x, y int) (r, g, b uint32) {
+	r, g, b, _ = img.(*Image).frames[0].At(x, y).RGBA()
+	return r >> 8, g >> 8, b >> 8
+}
+
+// shadeAt tells whether the pixel at x,y is "red", "blue" or neither.
+func shadeAt(img imgry.Image, x, y int) string {
+	r, _, b := rgbAt(img, x, y)
+	switch {
+	case r > 0xc0 && b < 0x40:
+		return "red"
+	case b > 0xc0 && r < 0x40:
+		return "blue"
+	}
+	return ""
+}
+
+func TestOrientation(t *testing.T) {
+	tdImage, err := ioutil.ReadFile(orientedFixture)
+	assert.NoError(t, err)
+
+	imfo, err := Engine{}.GetImageInfo(tdImage)
+	assert.NoError(t, err)
+	assert.Equal(t, 40, imfo.Width)
+	assert.Equal(t, 80, imfo.Height)
+
+	img := sizeOriented(t, sizing("size=20x"))
+	defer img.Release()
+
+	assert.Equal(t, 20, img.Width())
+	assert.Equal(t, 40, img.Height())
+	assert.Equal(t, "red", shadeAt(img, 10, 5))
+	assert.Equal(t, "blue", shadeAt(img, 10, 35))
+
+	// orient=0 leaves the pixels as they are
+	img2 := sizeOriented(t, sizing("orient=0"))
+	defer img2.Release()
+
+	assert.Equal(t, 80, img2.Width())
+	assert.Equal(t, 40, img2.Height())
+}
+
+func TestRotateFlip(t *testing.T) {
+	var tests = []struct {
+		query         string
+		width, height int
+		top, bottom   string
+	}{
+		{"rot=-90", 80, 40, "", ""},
+		{"rot=180", 40, 80, "blue", "red"},
+		{"flip=v", 40, 80, "blue", "red"},
+		{"flip=h", 40, 80, "red", "blue"},
+		{"rot=90&flip=h&size=40x", 40, 20, "", ""},
+		{"rot=45", 85, 85, "", ""},
+	}
+
+	for _, tt := range tests {
+		img := sizeOriented(t, sizing(tt.query))
+
+		assert.Equal(t, tt.width, img.Width(), tt.query)
+		assert.Equal(t, tt.height, img.Height(), tt.query)
+		if tt.top != "" {
+			assert.Equal(t, tt.top, shadeAt(img, tt.width/2, 5), tt.query)
+			assert.Equal(t, tt.bottom, shadeAt(img, tt.width/2, tt.height-5), tt.query)
+		}
+		img.Release()
+	}
+
+	// The corners of an odd angle are white without an alpha channel
+	img := sizeOriented(t, sizing("rot=30&bg=00ff00"))
+	r, g, b := rgbAt(img, 0, 0)
+	assert.Equal(t, []uint32{0, 0xff, 0}, []uint32{r, g, b})
+	img.Release()
+
+	// Every frame of an animation is turned
+	img, err := Engine{}.LoadFile("../testdata/issue-8.gif")
+	assert.NoError(t, err)
+	defer img.Release()
+
+	sz, _ := imgry.NewSizingFromQuery("rot=90&size=230x")
+	err = img.SizeIt(context.Background(), sz)
+	assert.NoError(t, err)
+
+	assert.Equal(t, 230, img.Width())
+	assert.Equal(t, 409, img.Height())
+	assert.True(t, len(img.(*Image).frames) > 1)
+	for _, m := range img.(*Image).frames {
+		assert.Equal(t, image.Rect(0, 0, 230, 409), m.Bounds())
+	}
+}
+
+func TestAdjust(t *testing.T) {
+	at := func(query string, x, y int) (r, g, b uint32) {
+		img := sizeOriented(t, sizing(query))
+		defer img.Release()
+
+		assert.Equal(t, 40, img.Width(), query)
+		assert.Equal(t, 80, img.Height(), query)
+		return rgbAt(img, x, y)
+	}
+
+	r, g, b := at("gray=1", 20, 10)
+	assert.True(t, r == g && g == b, "gray")
+	assert.True(t, r > 0x20 && r < 0x80, "gray")
+
+	r, g, b = at("sat=-100", 20, 10)
+	assert.True(t, r == g && g == b, "desaturated")
+
+	r0, _, _ := at("size=40x", 20, 10)
+	r, _, _ = at("bri=-50", 20, 10)
+	assert.True(t, r < r0, "darker")
+	r, _, _ = at("gamma=0.5", 20, 10)
+	assert.True(t, r < r0, "gamma")
+
+	// Blurring the edge between red and blue mixes them
+	_, _, b = at("size=40x", 20, 38)
+	assert.True(t, b < 0x40)
+	_, _, b = at("blur=5", 20, 38)
+	assert.True(t, b > 0x40)
+
+	// Sharpening brings the edge back
+	r0, _, _ = at("blur=2", 20, 38)
+	r, _, _ = at("blur=2&sharpen=2", 20, 38)
+	assert.True(t, r > r0)
+}
+
+func TestResampling(t *testing.T) {
+	at := func(query string, x, y int) (r, b uint32) {
+		img := sizeOriented(t, sizing(query))
+		defer img.Release()
+
+		assert.Equal(t, 400, img.Width(), query)
+		r, _, b = rgbAt(img, x, y)
+		return r, b
+	}
+
+	// Enlarged 10 times, the point filter keeps the edge between red and
+	// blue sharp where the default one blends it
+	r, b := at("size=400x&g=1", 200, 398)
+	assert.True(t, r > 0x20 && b > 0x20, "blended")
+	r, b = at("size=400x&g=1&filter=point", 200, 398)
+	assert.True(t, r > 0xc0 && b < 0x40, "sharp")
+
+	// The unsharp mask brings some of the edge back
+	r0, _ := at("size=400x&g=1&filter=triangle", 200, 394)
+	r, _ = at("size=400x&g=1&filter=triangle&usm=0,4,2", 200, 394)
+	assert.True(t, r > r0)
+}
+
+func TestWatermark(t *testing.T) {
+	// A red square, showing on the blue bottom half
+	var buf bytes.Buffer
+	red := image.NewNRGBA(image.Rect(0, 0, 8, 8))
+	draw.Draw(red, red.Bounds(), image.NewUniform(color.NRGBA{0xff, 0, 0, 0xff}), image.ZP, draw.Src)
+	assert.NoError(t, png.Encode(&buf, red))
+
+	var tests = []struct {
+		query string
+		x, y  int
+		red   bool
+	}{
+		{"size=40x", 35, 75, false},
+		{"size=40x&wm=b/k&wm_scale=0.25", 35, 75, true},
+		{"size=40x&wm=b/k&wm_scale=0.25&wm_margin=10", 35, 75, false},
+		{"size=40x&wm=b/k&wm_scale=0.25&wm_margin=10", 25, 65, true},
+		{"size=40x&wm=b/k&wm_scale=0.25&wm_pos=sw", 5, 75, true},
+		{"size=40x&wm=b/k&wm_scale=0.25&wm_pos=sw", 35, 75, false},
+	}
+
+	for _, tt := range tests {
+		sz := sizing(tt.query)
+		if sz.Watermark != nil {
+			sz.Watermark.Data = buf.Bytes()
+		}
+		img := sizeOriented(t, sz)
+
+		r, _, b := rgbAt(img, tt.x, tt.y)
+		assert.Equal(t, tt.red, r > b, tt.query)
+		img.Release()
+	}
+
+	// Half see-through
+	sz := sizing("size=40x&wm=b/k&wm_scale=1&wm_alpha=0.5")
+	sz.Watermark.Data = buf.Bytes()
+	img := sizeOriented(t, sz)
+	defer img.Release()
+
+	r, _, b := rgbAt(img, 20, 70)
+	assert.True(t, r > 0x40 && b > 0x40)
+}
+
+func TestTextUnsupported(t *testing.T) {
+	ng := Engine{}
+
+	img, err := ng.LoadFile("../testdata/gophers.jpg")
+	assert.NoError(t, err)
+	defer img.Release()
+
+	sz, _ := imgry.NewSizingFromQuery("size=100x&txt=Hi")
+	err = img.SizeIt(context.Background(), sz)
+	assert.Equal(t, ErrUnsupportedText, err)
+}
+
+func TestEmptyCropBox(t *testing.T) {
+	ng := Engine{}
+
+	img, err := ng.LoadFile("../testdata/gophers.jpg")
+	assert.NoError(t, err)
+	defer img.Release()
+
+	// Valid, but narrower than a pixel of the image
+	sz, _ := imgry.NewSizingFromQuery("size=300x&op=cover&cb=0.5,0,0.5005,1")
+	assert.NoError(t, sz.Validate(nil))
+	err = img.SizeIt(context.Background(), sz)
+	assert.Equal(t, imgry.ErrEmptyCropBox, err)
+}
+
+func TestFormats(t *testing.T) {
+	ng := Engine{}
+	assert.Equal(t, []string{"jpg", "png", "gif", "bmp", "ico"}, ng.Formats())
+
+	img, err := ng.LoadFile("../testdata/gophers.jpg")
+	assert.NoError(t, err)
+	defer img.Release()
+
+	for _, format := range []string{"webp", "avif", "jxl"} {
+		sz, _ := imgry.NewSizingFromQuery("size=100x&format=" + format)
+		err = img.SizeIt(context.Background(), sz)
+		assert.Equal(t, ErrUnsupportedFormat, err, format)
+	}
+}
+
+func TestAutoFormat(t *testing.T) {
+	ng := Engine{}
+
+	encode := func(m image.Image) []byte {
+		var buf bytes.Buffer
+		assert.NoError(t, png.Encode(&buf, m))
+		return buf.Bytes()
+	}
+
+	// Two flat colors, a smooth gradient, and the same see-through
+	flat := image.NewNRGBA(image.Rect(0, 0, 64, 64))
+	photo := image.NewNRGBA(image.Rect(0, 0, 64, 64))
+	clear := image.NewNRGBA(image.Rect(0, 0, 64, 64))
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 64; x++ {
+			flat.Set(x, y, color.NRGBA{0xff, 0, 0, 0xff})
+			if x >= 32 {
+				flat.Set(x, y, color.NRGBA{0, 0, 0xff, 0xff})
+			}
+			photo.Set(x, y, color.NRGBA{uint8(x * 4), uint8(y * 4), 0x80, 0xff})
+			clear.Set(x, y, color.NRGBA{uint8(x * 4), uint8(y * 4), 0x80, 0x80})
+		}
+	}
+	gifImage, err := ioutil.ReadFile("../testdata/issue-8.gif")
+	assert.NoError(t, err)
+
+	var tests = []struct {
+		name   string
+		data   []byte
+		format string
+	}{
+		{"flat", encode(flat), "png"},
+		{"photo", encode(photo), "jpg"},
+		{"clear", encode(clear), "png"},
+		{"animated", gifImage, "gif"},
+	}
+	for _, tt := range tests {
+		img, err := ng.LoadBlob(context.Background(), tt.data)
+		assert.NoError(t, err)
+
+		sz, _ := imgry.NewSizingFromQuery("format=auto")
+		err = img.SizeIt(context.Background(), sz)
+		assert.NoError(t, err, tt.name)
+		assert.Equal(t, tt.format, img.Format(), tt.name)
+
+		imfo, err := ng.GetImageInfo(img.Data())
+		assert.NoError(t, err, tt.name)
+		assert.Equal(t, tt.format, imfo.Format, tt.name)
+
+		img.Release()
+	}
+
+	// Flat graphics are a palette PNG
+	img, err := ng.LoadBlob(context.Background(), encode(flat))
+	assert.NoError(t, err)
+	defer img.Release()
+	sz, _ := imgry.NewSizingFromQuery("format=auto")
+	assert.NoError(t, img.SizeIt(context.Background(), sz))
+	m, err := png.Decode(bytes.NewReader(img.Data()))
+	assert.NoError(t, err)
+	if assert.IsType(t, &image.Paletted{}, m) {
+		assert.Len(t, m.(*image.Paletted).Palette, 2)
+	}
+}
+
+func TestFlattenAlpha(t *testing.T) {
+	ng := Engine{}
+
+	// Transparent on the left, green on the right
+	var buf bytes.Buffer
+	src := image.NewNRGBA(image.Rect(0, 0, 64, 64))
+	draw.Draw(src, image.Rect(32, 0, 64, 64), image.NewUniform(color.NRGBA{0, 0xff, 0, 0xff}), image.ZP, draw.Src)
+	assert.NoError(t, png.Encode(&buf, src))
+	tdImage := buf.Bytes()
+
+	var tests = []struct {
+		query string
+		x, y  int
+		want  color.NRGBA
+	}{
+		{"format=png", 8, 32, color.NRGBA{}},
+		{"format=jpg", 8, 32, color.NRGBA{0xff, 0xff, 0xff, 0xff}},
+		{"format=jpg&bg=ff0000", 8, 32, color.NRGBA{0xff, 0, 0, 0xff}},
+		{"format=jpg&bg=ff0000", 56, 32, color.NRGBA{0, 0xff, 0, 0xff}},
+		{"size=32x32&canvas=64x64&format=jpg&bg=0000ff", 2, 2, color.NRGBA{0, 0, 0xff, 0xff}},
+		{"size=32x32&canvas=64x64&format=png&bg=0000ff", 2, 2, color.NRGBA{}},
+	}
+	for _, tt := range tests {
+		img, err := ng.LoadBlob(context.Background(), tdImage)
+		assert.NoError(t, err)
+
+		sz, _ := imgry.NewSizingFromQuery(tt.query)
+		err = img.SizeIt(context.Background(), sz)
+		assert.NoError(t, err, tt.query)
+
+		m, _, err := image.Decode(bytes.NewReader(img.Data()))
+		if assert.NoError(t, err, tt.query) {
+			c := color.NRGBAModel.Convert(m.At(tt.x, tt.y)).(color.NRGBA)
+			if tt.want.A == 0 {
+				assert.Equal(t, uint8(0), c.A, tt.query)
+			} else {
+				near := func(a, b uint8) bool { return int(a)-int(b) < 16 && int(b)-int(a) < 16 }
+				assert.True(t, near(c.R, tt.want.R) && near(c.G, tt.want.G) && near(c.B, tt.want.B) && c.A == 0xff, "%s: %v", tt.query, c)
+			}
+		}
+
+		img.Release()
+	}
+}
+
+func TestSizeItCanceled(t *testing.T) {
+	ng := Engine{}
+
+	img, err := ng.LoadFile("../testdata/issue-8.gif")
+	assert.NoError(t, err)
+	defer img.Release()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	sz, _ := imgry.NewSizingFromQuery("size=200x")
+	err = img.SizeIt(ctx, sz)
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, 817, img.Width())
+
+	// The image is still usable after an aborted sizing
+	err = img.SizeIt(context.Background(), sz)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, img.Width())
+}
+
+func TestClone(t *testing.T) {
+	ng := Engine{}
+
+	img, err := ng.LoadFile("../testdata/gophers.png")
+	assert.NoError(t, err)
+	defer img.Release()
+
+	img2 := img.(*Image).Clone()
+	defer img2.Release()
+
+	sz, _ := imgry.NewSizingFromQuery("size=100x")
+	err = img2.SizeIt(context.Background(), sz)
+	assert.NoError(t, err)
+
+	assert.Equal(t, 100, img2.Width())
+	assert.NotEqual(t, 100, img.Width())
+}
+
+func TestSizeMany(t *testing.T) {
+	ng := Engine{}
+
+	img, err := ng.LoadFile("../testdata/image1.jpg")
+	assert.NoError(t, err)
+	defer img.Release()
+
+	sz1, _ := imgry.NewSizingFromQuery("size=400x")
+	sz2, _ := imgry.NewSizingFromQuery("size=100x100&op=cover&format=png")
+
+	images, err := imgry.SizeMany(context.Background(), img, []*imgry.Sizing{sz1, sz2})
+	assert.NoError(t, err)
+	assert.Len(t, images, 2)
+
+	assert.Equal(t, 400, images[0].Width())
+	assert.Equal(t, "jpg", images[0].Format())
+	assert.Equal(t, 100, images[1].Width())
+	assert.Equal(t, 100, images[1].Height())
+	assert.Equal(t, "png", images[1].Format())
+
+	// The source image is left as is
+	assert.Equal(t, 1600, img.Width())
+
+	for _, im := range images {
+		im.Release()
+	}
+}
@@ -0,0 +1,176 @@
+package imagex
+
+import (
+	"encoding/binary"
+	"image"
+	"image/color"
+	"math"
+
+	"golang.org/x/image/draw"
+	"golang.org/x/image/math/f64"
+)
+
+// jpegOrientation returns the EXIF orientation of a JPEG, from 1 to 8, or
+// 1 when it has none.
+func jpegOrientation(b []byte) int {
+	if len(b) < 4 || b[0] != 0xff || b[1] != 0xd8 {
+		return 1
+	}
+
+	// Walk the segments up to the image data, looking for the EXIF one
+	for i := 2; i+4 <= len(b); {
+		if b[i] != 0xff {
+			return 1
+		}
+		marker := b[i+1]
+		switch {
+		case marker == 0xff:
+			i++ // fill byte
+			continue
+		case marker == 0xda || marker == 0xd9:
+			return 1
+		case marker == 0x01 || (marker >= 0xd0 && marker <= 0xd7):
+			i += 2 // no length
+			continue
+		}
+
+		size := int(b[i+2])<<8 | int(b[i+3])
+		if size < 2 || i+2+size > len(b) {
+			return 1
+		}
+		if marker == 0xe1 {
+			if o := exifOrientation(b[i+4 : i+2+size]); o > 0 {
+				return o
+			}
+		}
+		i += 2 + size
+	}
+	return 1
+}
+
+// exifOrientation reads the orientation tag of the first IFD of an EXIF
+// segment, 0 when it isn't there.
+func exifOrientation(b []byte) int {
+	if len(b) < 14 || string(b[:6]) != "Exif\x00\x00" {
+		return 0
+	}
+	t := b[6:]
+
+	var bo binary.ByteOrder
+	switch string(t[:2]) {
+	case "II":
+		bo = binary.LittleEndian
+	case "MM":
+		bo = binary.BigEndian
+	default:
+		return 0
+	}
+	if bo.Uint16(t[2:]) != 42 {
+		return 0
+	}
+
+	ifd := int(bo.Uint32(t[4:]))
+	if ifd < 8 || ifd+2 > len(t) {
+		return 0
+	}
+	n := int(bo.Uint16(t[ifd:]))
+	for k := 0; k < n; k++ {
+		e := ifd + 2 + k*12
+		if e+12 > len(t) {
+			return 0
+		}
+		if bo.Uint16(t[e:]) == 0x0112 {
+			if o := int(bo.Uint16(t[e+8:])); o >= 1 && o <= 8 {
+				return o
+			}
+			return 0
+		}
+	}
+	return 0
+}
+
+// swapsSides reports whether an image of EXIF orientation o is displayed
+// with its width and height swapped.
+func swapsSides(o int) bool {
+	return o >= 5 && o <= 8
+}
+
+// orient returns m turned the way its EXIF orientation o says it is
+// displayed.
+func orient(m image.Image, o int) image.Image {
+	if o <= 1 || o > 8 {
+		return m
+	}
+
+	b := m.Bounds()
+	src := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(src, src.Bounds(), m, b.Min, draw.Src)
+
+	w, h := b.Dx(), b.Dy()
+	dw, dh := w, h
+	if swapsSides(o) {
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch o {
+			case 2: // mirrored
+				dx, dy = w-1-x, y
+			case 3: // upside down
+				dx, dy = w-1-x, h-1-y
+			case 4: // mirrored upside down
+				dx, dy = x, h-1-y
+			case 5: // transposed
+				dx, dy = y, x
+			case 6: // turned 90° clockwise
+				dx, dy = h-1-y, x
+			case 7: // transversed
+				dx, dy = h-1-y, w-1-x
+			case 8: // turned 90° counter clockwise
+				dx, dy = y, w-1-x
+			}
+			si := src.PixOffset(x, y)
+			di := dst.PixOffset(dx, dy)
+			copy(dst.Pix[di:di+4], src.Pix[si:si+4])
+		}
+	}
+	return dst
+}
+
+// rotate returns m turned clockwise by deg degrees. Right angles are exact,
+// other ones are interpolated onto the bounding box of the turned image,
+// with its corners filled with fill.
+func rotate(m image.Image, deg float64, fill color.NRGBA) image.Image {
+	switch deg {
+	case 90:
+		return orient(m, 6)
+	case 180:
+		return orient(m, 3)
+	case 270:
+		return orient(m, 8)
+	}
+
+	b := m.Bounds()
+	sin, cos := math.Sincos(deg * math.Pi / 180)
+	w, h := float64(b.Dx()), float64(b.Dy())
+	dw := math.Abs(w*cos) + math.Abs(h*sin)
+	dh := math.Abs(w*sin) + math.Abs(h*cos)
+
+	dst := image.NewRGBA(image.Rect(0, 0, int(dw+0.5), int(dh+0.5)))
+	if fill != (color.NRGBA{}) {
+		draw.Draw(dst, dst.Bounds(), image.NewUniform(fill), image.ZP, draw.Src)
+	}
+
+	// Turns the source around its center, which ends up at the center of
+	// the destination
+	cx, cy := float64(b.Min.X)+w/2, float64(b.Min.Y)+h/2
+	s2d := f64.Aff3{
+		cos, -sin, float64(dst.Bounds().Dx())/2 - (cos*cx - sin*cy),
+		sin, cos, float64(dst.Bounds().Dy())/2 - (sin*cx + cos*cy),
+	}
+	draw.BiLinear.Transform(dst, s2d, m, b, draw.Over, nil)
+	return dst
+}
@@ -0,0 +1,48 @@
+package imagex
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+
+	"github.com/pressly/imgry"
+	"golang.org/x/image/draw"
+)
+
+// overlay is the decoded watermark of a sizing, scaled once for all of the
+// frames it's put on.
+type overlay struct {
+	src    image.Image
+	scaled *image.RGBA
+}
+
+func newOverlay(wm *imgry.Watermark) (*overlay, error) {
+	m, format, err := image.Decode(bytes.NewReader(wm.Data))
+	if err != nil {
+		return nil, err
+	}
+	if format == "jpeg" {
+		m = orient(m, jpegOrientation(wm.Data))
+	}
+	return &overlay{src: m}, nil
+}
+
+// drawOn returns a copy of m with the overlay composited onto it, the way
+// the watermark of the sizing says.
+func (o *overlay) drawOn(m image.Image, sz *imgry.Sizing) image.Image {
+	b, sb := m.Bounds(), o.src.Bounds()
+	size, origin := sz.CalcWatermark(imgry.NewRect(b.Dx(), b.Dy()), imgry.NewRect(sb.Dx(), sb.Dy()))
+
+	if o.scaled == nil || o.scaled.Rect.Dx() != size.Width || o.scaled.Rect.Dy() != size.Height {
+		o.scaled = image.NewRGBA(image.Rect(0, 0, size.Width, size.Height))
+		draw.CatmullRom.Scale(o.scaled, o.scaled.Rect, o.src, sb, draw.Src, nil)
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(dst, dst.Rect, m, b.Min, draw.Src)
+
+	r := image.Rect(origin.X, origin.Y, origin.X+size.Width, origin.Y+size.Height)
+	alpha := image.NewUniform(color.Alpha16{uint16(sz.Watermark.Alpha*0xffff + 0.5)})
+	draw.DrawMask(dst, r, o.scaled, image.ZP, alpha, image.ZP, draw.Over)
+	return dst
+}
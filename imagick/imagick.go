@@ -1,13 +1,20 @@
 package imagick
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"image"
+	"image/color"
 	"io/ioutil"
+	"math"
 	"os"
 	"path/filepath"
+	"runtime"
+	"strconv"
 	"strings"
 
+	"github.com/goware/go-metrics"
 	"github.com/pressly/imgry"
 	"gopkg.in/gographics/imagick.v3/imagick"
 )
@@ -17,15 +24,31 @@ var (
 	ErrEngineFailure  = errors.New("imagick: unable to request a MagickWand")
 )
 
+// The filters of imgry.ResampleFilters
+var resampleFilters = map[string]imagick.FilterType{
+	"lanczos":  imagick.FILTER_LANCZOS,
+	"mitchell": imagick.FILTER_MITCHELL,
+	"catrom":   imagick.FILTER_CATROM,
+	"point":    imagick.FILTER_POINT,
+	"box":      imagick.FILTER_BOX,
+	"triangle": imagick.FILTER_TRIANGLE,
+}
+
+func init() {
+	imgry.RegisterEngine("imagick", func() imgry.Engine {
+		return Engine{}
+	})
+}
+
 type Engine struct {
 	tmpDir string
-	// TODO: perhaps we have counter of wands here..
-	// it ensures we'll always release them..
-	// AvailableWands .. .. set to MaxSizers ..
-	// then, NewMagickWand() will limit, or error..
-	// perhaps we make a channel of these things..
-	// then block.. + ctx will have a timeout if it wants to stop waiting..
-	// we can log these timeouts etc..
+
+	// Limits caps the resources ImageMagick may use, applied on Initialize.
+	Limits ResourceLimits
+
+	// Wands bounds the number of images alive at once, loads wait for a
+	// slot of the pool. A nil pool is unbounded.
+	Wands *WandPool
 }
 
 func (ng Engine) Version() string {
@@ -43,7 +66,47 @@ func (ng Engine) Initialize(tmpDir string) error {
 		ng.SweepTmpDir()
 	}
 	imagick.Initialize()
-	return nil
+	encoders = queryEncoders()
+	return ng.Limits.apply()
+}
+
+// Formats lists the output formats of imgry the ImageMagick build has a
+// coder for, avif and jxl depend on the delegates it was built with.
+func (ng Engine) Formats() []string {
+	return append([]string(nil), encoders...)
+}
+
+// DrawsText reports that text can be drawn, see imgry.DrawsText.
+func (ng Engine) DrawsText() bool {
+	return true
+}
+
+// outputFormats are the formats imgry serves, when ImageMagick has them
+var outputFormats = []string{"jpg", "png", "gif", "webp", "avif", "jxl", "bmp", "ico"}
+
+// encoders are the output formats found at Initialize
+var encoders []string
+
+func queryEncoders() []string {
+	mw := imagick.NewMagickWand()
+	defer mw.Destroy()
+
+	found := map[string]bool{}
+	for _, f := range mw.QueryFormats("*") {
+		f = strings.ToLower(f)
+		if f == "jpeg" {
+			f = "jpg"
+		}
+		found[f] = true
+	}
+
+	var formats []string
+	for _, f := range outputFormats {
+		if found[f] {
+			formats = append(formats, f)
+		}
+	}
+	return formats
 }
 
 func (ng Engine) Terminate() {
@@ -80,16 +143,23 @@ func (ng Engine) LoadFile(filename string, srcFormat ...string) (imgry.Image, er
 	if err != nil {
 		return nil, err
 	}
-	return ng.LoadBlob(b, srcFormat...)
+	return ng.LoadBlob(context.Background(), b, srcFormat...)
 }
 
-func (ng Engine) LoadBlob(b []byte, srcFormat ...string) (imgry.Image, error) {
+// LoadBlob decodes the image once a slot of the wand pool is free, giving
+// up when the context is done first.
+func (ng Engine) LoadBlob(ctx context.Context, b []byte, srcFormat ...string) (imgry.Image, error) {
 	if len(b) == 0 {
 		return nil, imgry.ErrInvalidImageData
 	}
 
+	if err := ng.Wands.acquire(ctx); err != nil {
+		return nil, err
+	}
+
 	mw := imagick.NewMagickWand()
 	if !mw.IsVerified() {
+		ng.Wands.release()
 		return nil, ErrEngineFailure
 	}
 
@@ -104,16 +174,19 @@ func (ng Engine) LoadBlob(b []byte, srcFormat ...string) (imgry.Image, error) {
 	err := mw.ReadImageBlob(b)
 	if err != nil {
 		mw.Destroy()
+		ng.Wands.release()
 		return nil, imgry.ErrInvalidImageData
 	}
 
-	// TODO: perhaps we pass the engine instance like Image{engine: i}
-	im := &Image{mw: mw, data: b}
+	im := newImage(mw, ng.Wands)
 	if err := im.sync(); err != nil {
-		mw.Destroy()
+		im.Release()
 		return nil, err
 	}
 
+	// Nothing has changed yet, so the source blob is still our data
+	im.data = b
+
 	return im, nil
 }
 
@@ -134,7 +207,11 @@ func (ng Engine) GetImageInfo(b []byte, srcFormat ...string) (*imgry.ImageInfo,
 		return nil, imgry.ErrInvalidImageData
 	}
 
+	// The dimensions the image is displayed with
 	w, h := int(mw.GetImageWidth()), int(mw.GetImageHeight())
+	if swapsSides(mw.GetImageOrientation()) {
+		w, h = h, w
+	}
 	ar := float64(int(float64(w)/float64(h)*10000)) / 10000
 
 	format := strings.ToLower(mw.GetImageFormat())
@@ -145,21 +222,42 @@ func (ng Engine) GetImageInfo(b []byte, srcFormat ...string) (*imgry.ImageInfo,
 	imfo := &imgry.ImageInfo{
 		Format: format, Width: w, Height: h,
 		AspectRatio: ar, ContentLength: len(b),
+		Frames: int(mw.GetNumberImages()),
 	}
 
 	return imfo, nil
 }
 
 type Image struct {
-	mw *imagick.MagickWand
+	mw    *imagick.MagickWand
+	wands *WandPool // holding one of its slots until released
+
+	data    []byte // encoded lazily, see Data()
+	flatten bool
+	width   int
+	height  int
+	format  string
+}
 
-	data   []byte
-	width  int
-	height int
-	format string
+func newImage(mw *imagick.MagickWand, wands *WandPool) *Image {
+	im := &Image{mw: mw, wands: wands}
+	runtime.SetFinalizer(im, leaked)
+	return im
+}
+
+// leaked releases an image that was dropped without calling Release, so
+// that its wand and slot aren't lost for good.
+func leaked(i *Image) {
+	if !i.Released() {
+		metrics.IncrCounter([]string{"fn.imagick.WandLeaks"}, 1)
+		i.Release()
+	}
 }
 
 func (i *Image) Data() []byte {
+	if i.data == nil && !i.Released() {
+		i.data = i.blob(i.flatten)
+	}
 	return i.data
 }
 
@@ -196,40 +294,80 @@ func (i *Image) Release() {
 	if i.mw != nil {
 		i.mw.Destroy()
 		i.mw = nil
+		i.wands.release()
+		i.wands = nil
+		runtime.SetFinalizer(i, nil)
 	}
 }
 
+// Clone returns a copy of the image. The copy takes its own slot of the
+// wand pool without waiting for it, as its source already holds one.
 func (i *Image) Clone() imgry.Image {
 	i2 := &Image{}
+	if i.mw != nil && i.mw.IsVerified() {
+		i.wands.add()
+		i2 = newImage(i.mw.Clone(), i.wands)
+	}
 	i2.data = i.data
+	i2.flatten = i.flatten
 	i2.width = i.width
 	i2.height = i.height
 	i2.format = i.format
-	if i.mw != nil && i.mw.IsVerified() {
-		i2.mw = i.mw.Clone()
-	}
 	return i2
 }
 
-func (i *Image) SizeIt(sz *imgry.Sizing) error {
+// SizeIt sizes the image in place. The sizing is aborted as soon as the
+// context is done, in which case the context error is returned.
+func (i *Image) SizeIt(ctx context.Context, sz *imgry.Sizing) error {
 	if i.Released() {
 		return ErrEngineReleased
 	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 
-	if err := i.sizeFrames(sz); err != nil {
+	if err := i.orient(sz.KeepOrientation); err != nil {
 		return err
 	}
 
-	if sz.Format != "" {
-		if err := i.mw.SetFormat(sz.Format); err != nil {
+	if err := i.sizeFrames(ctx, sz); err != nil {
+		return err
+	}
+
+	format := sz.Format
+	if format == imgry.FormatAuto {
+		var err error
+		if format, err = i.autoFormat(); err != nil {
+			return err
+		}
+	}
+	if format != "" {
+		if err := i.mw.SetFormat(format); err != nil {
+			return err
+		}
+	} else {
+		format = i.Format()
+	}
+	format = strings.ToLower(format)
+
+	// what's transparent goes onto the background in formats without alpha
+	if !imgry.FormatHasAlpha(format) {
+		if err := i.flattenAlpha(sz.FillColor(format)); err != nil {
 			return err
 		}
 	}
 
 	// progressive jpegs
-	if i.Format() == "jpg" {
+	if format == "jpg" || format == "jpeg" {
 		i.mw.SetInterlaceScheme(imagick.INTERLACE_PLANE)
 	}
+	// lossy webp at the quality below, unless asked otherwise. Animations
+	// stay animated as the frames are written together.
+	if format == "webp" && sz.Lossless {
+		if err := i.mw.SetOption("webp:lossless", "true"); err != nil {
+			return err
+		}
+	}
 	// exif and color profiles begone
 	i.mw.StripImage()
 	// compress it!
@@ -246,36 +384,226 @@ func (i *Image) SizeIt(sz *imgry.Sizing) error {
 	return nil
 }
 
-func (i *Image) sizeFrames(sz *imgry.Sizing) error {
+// autoFormat picks the format of FormatAuto for the sized image, palette
+// PNG for flat graphics. Animations keep their format.
+func (i *Image) autoFormat() (string, error) {
+	if i.mw.GetNumberImages() > 1 {
+		return i.Format(), nil
+	}
+
+	alpha, err := i.usesAlpha()
+	if err != nil {
+		return "", err
+	}
+	colors := int(i.mw.GetImageColors())
+	format := imgry.AutoFormat(alpha, colors)
+
+	if format == "png" && colors <= imgry.MaxPaletteColors {
+		typ := imagick.IMAGE_TYPE_PALETTE
+		if alpha {
+			typ = imagick.IMAGE_TYPE_PALETTE_ALPHA
+		}
+		if err := i.mw.SetImageType(typ); err != nil {
+			return "", err
+		}
+	}
+	return format, nil
+}
+
+// flattenAlpha composites every frame onto the color c, removing their
+// alpha channel.
+func (i *Image) flattenAlpha(c color.NRGBA) error {
+	bg := imagick.NewPixelWand()
+	defer bg.Destroy()
+	bg.SetColor(pixelColor(c))
+
+	i.mw.SetFirstIterator()
+	for n := true; n; n = i.mw.NextImage() {
+		if err := i.mw.SetImageBackgroundColor(bg); err != nil {
+			return err
+		}
+		if err := i.mw.SetImageAlphaChannel(imagick.ALPHA_CHANNEL_REMOVE); err != nil {
+			return err
+		}
+	}
+	i.mw.SetFirstIterator()
+	return nil
+}
+
+// usesAlpha reports whether any pixel of the current frame isn't opaque.
+func (i *Image) usesAlpha() (bool, error) {
+	px, err := i.mw.ExportImagePixels(0, 0, i.mw.GetImageWidth(), i.mw.GetImageHeight(), "A", imagick.PIXEL_CHAR)
+	if err != nil {
+		return false, err
+	}
+	for _, a := range px.([]byte) {
+		if a != 0xff {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// orient turns the frames upright, as their EXIF orientation says they're
+// displayed, or only marks them upright when keep is set. The orientation
+// is stripped along with the rest of the EXIF data after sizing.
+func (i *Image) orient(keep bool) error {
+	i.mw.SetFirstIterator()
+	for n := true; n; n = i.mw.NextImage() {
+		o := i.mw.GetImageOrientation()
+		if o == imagick.ORIENTATION_UNDEFINED || o == imagick.ORIENTATION_TOP_LEFT {
+			continue
+		}
+		if !keep {
+			if err := i.mw.AutoOrientImage(); err != nil {
+				return err
+			}
+		}
+		if err := i.mw.SetImageOrientation(imagick.ORIENTATION_TOP_LEFT); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rotate turns the current frame clockwise and then mirrors it, as the
+// sizing says, filling the corners of an odd angle with bg.
+func (i *Image) rotate(sz *imgry.Sizing, bg *imagick.PixelWand) error {
+	if sz.Rotate != 0 {
+		if err := i.mw.RotateImage(bg, sz.Rotate); err != nil {
+			return err
+		}
+	}
+	if strings.Contains(sz.Flip, "h") {
+		if err := i.mw.FlopImage(); err != nil {
+			return err
+		}
+	}
+	if strings.Contains(sz.Flip, "v") {
+		if err := i.mw.FlipImage(); err != nil {
+			return err
+		}
+	}
+	return i.mw.ResetImagePage("")
+}
+
+// adjust applies the adjustment filters of the sizing to the current
+// frame, in the order they're listed in imgry.Sizing.
+func (i *Image) adjust(sz *imgry.Sizing) error {
+	mw := i.mw
+	if sz.Grayscale {
+		// Back to sRGB so the frame still fits its format and any canvas
+		if err := mw.TransformImageColorspace(imagick.COLORSPACE_GRAY); err != nil {
+			return err
+		}
+		if err := mw.TransformImageColorspace(imagick.COLORSPACE_SRGB); err != nil {
+			return err
+		}
+	}
+	if sz.Brightness != 0 || sz.Contrast != 0 {
+		if err := mw.BrightnessContrastImage(float64(sz.Brightness), float64(sz.Contrast)); err != nil {
+			return err
+		}
+	}
+	if sz.Saturation != 0 {
+		if err := mw.ModulateImage(100, float64(100+sz.Saturation), 100); err != nil {
+			return err
+		}
+	}
+	if sz.Gamma != 0 {
+		if err := mw.GammaImage(sz.Gamma); err != nil {
+			return err
+		}
+	}
+	if sz.Blur != 0 {
+		if err := mw.GaussianBlurImage(0, sz.Blur); err != nil {
+			return err
+		}
+	}
+	if sz.Sharpen != 0 {
+		if err := mw.SharpenImage(0, sz.Sharpen); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (i *Image) sizeFrames(ctx context.Context, sz *imgry.Sizing) error {
 	var canvas *imagick.MagickWand
 	var bg *imagick.PixelWand
 
 	// Shortcut if there is nothing to size
-	if sz.Size.Equal(imgry.ZeroRect) && sz.CropBox.Equal(imgry.ZeroFloatingRect) {
+	if !sz.Transforms() {
 		return nil
 	}
 
+	// Let ImageMagick abort long running operations once the context is done
+	monitor := watchProgress(ctx)
+	defer monitor.stop()
+
 	coalesceAndDeconstruct := !sz.Flatten && i.mw.GetNumberImages() > 1
 	if coalesceAndDeconstruct {
 		i.mw = i.mw.CoalesceImages()
 	}
+	sz.ResolveDPR(imgry.NewRect(int(i.mw.GetImageWidth()), int(i.mw.GetImageHeight())))
 
-	if sz.Canvas != nil {
-		// If the user requested a canvas.
-		canvas = imagick.NewMagickWand()
-		bg = imagick.NewPixelWand()
-		bg.SetColor("transparent")
+	// Canvases are transparent, padding and the corners left by a rotation
+	// are filled as the sizing says
+	format := sz.Format
+	if format == "" {
+		format = i.format
+	}
+	fill := sz.CanvasFill(format)
 
-		defer func() {
-			bg.Destroy()
-			if canvas != nil && canvas != i.mw {
-				canvas.Destroy()
-			}
-		}()
+	var rotBg *imagick.PixelWand
+	if sz.Rotate != 0 {
+		rotBg = imagick.NewPixelWand()
+		rotBg.SetColor(pixelColor(sz.FillColor(format)))
+	}
+
+	var wm *imagick.MagickWand
+	var wmSize *imgry.Rect
+	if sz.Watermark != nil {
+		wm = imagick.NewMagickWand()
+		if err := wm.ReadImageBlob(sz.Watermark.Data); err != nil {
+			wm.Destroy()
+			return err
+		}
+		wm.SetFirstIterator()
+		if err := wm.AutoOrientImage(); err != nil {
+			wm.Destroy()
+			return err
+		}
+		wmSize = imgry.NewRect(int(wm.GetImageWidth()), int(wm.GetImageHeight()))
 	}
 
+	defer func() {
+		if wm != nil {
+			wm.Destroy()
+		}
+		if rotBg != nil {
+			rotBg.Destroy()
+		}
+		if bg != nil {
+			bg.Destroy()
+		}
+		if canvas != nil && canvas != i.mw {
+			canvas.Destroy()
+		}
+	}()
+
 	i.mw.SetFirstIterator()
 	for n := true; n; n = i.mw.NextImage() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		monitor.attach(i.mw)
+
+		// Turn and mirror the frame, before it's cropped
+		if err := i.rotate(sz, rotBg); err != nil {
+			return monitor.err(err)
+		}
+
 		pw, ph := int(i.mw.GetImageWidth()), int(i.mw.GetImageHeight())
 		srcSize := imgry.NewRect(pw, ph)
 
@@ -284,55 +612,98 @@ func (i *Image) sizeFrames(sz *imgry.Sizing) error {
 		if err != nil {
 			return err
 		}
+		if cropBox != nil && !cropBox.Equal(imgry.ZeroRect) && (cropBox.Width <= 0 || cropBox.Height <= 0) {
+			return imgry.ErrEmptyCropBox
+		}
 
 		if cropBox != nil && cropOrigin != nil && !cropBox.Equal(imgry.ZeroRect) {
 			err := i.mw.CropImage(uint(cropBox.Width), uint(cropBox.Height), cropOrigin.X, cropOrigin.Y)
 			if err != nil {
-				return err
+				return monitor.err(err)
 			}
 			srcSize = cropBox
 			i.mw.ResetImagePage("")
 		}
 
+		// Find the focal point of the auto gravity on the first frame
+		if sz.NeedsFocalPoint() {
+			fp, err := focalPoint(i.mw)
+			if err != nil {
+				return monitor.err(err)
+			}
+			sz.FocalPoint = fp
+		}
+
 		// Resize the image
 		resizeRect, cropBox, cropOrigin := sz.CalcResizeRect(srcSize)
 		if resizeRect != nil && !resizeRect.Equal(imgry.ZeroRect) {
-			var resizeFilter imagick.FilterType
-
-			if resizeRect.Width > sz.Size.Width {
-				// use Mitchell-Netravali cubic filter when enlarging
-				resizeFilter = imagick.FILTER_MITCHELL
-			} else {
-				// use sharp variant of 3-lobed cylindrical lanczos when shrinking
-				resizeFilter = imagick.FILTER_LANCZOS_SHARP
+			resizeFilter, ok := resampleFilters[sz.Filter]
+			if !ok {
+				if resizeRect.Width > sz.ScaledSize().Width {
+					// use Mitchell-Netravali cubic filter when enlarging
+					resizeFilter = imagick.FILTER_MITCHELL
+				} else {
+					// use sharp variant of 3-lobed cylindrical lanczos when shrinking
+					resizeFilter = imagick.FILTER_LANCZOS_SHARP
+				}
 			}
 
 			err := i.mw.ResizeImage(uint(resizeRect.Width), uint(resizeRect.Height), resizeFilter)
 			if err != nil {
-				return err
+				return monitor.err(err)
 			}
 			i.mw.ResetImagePage("")
 		}
 
+		// Sharpen what the resize softened
+		if usm := sz.Unsharp; usm != nil {
+			if err := i.mw.UnsharpMaskImage(usm.Radius, usm.Sigma, usm.Amount, usm.Threshold); err != nil {
+				return monitor.err(err)
+			}
+		}
+
 		// Perform any final crops from an operation
 		if cropBox != nil && cropOrigin != nil && !cropBox.Equal(imgry.ZeroRect) {
 			err := i.mw.CropImage(uint(cropBox.Width), uint(cropBox.Height), cropOrigin.X, cropOrigin.Y)
 			if err != nil {
-				return err
+				return monitor.err(err)
 			}
 			i.mw.ResetImagePage("")
 		}
 
-		// If we have a canvas we put the image at its center.
-		if canvas != nil {
-			canvas.NewImage(uint(sz.Canvas.Width), uint(sz.Canvas.Height), bg)
+		// Adjust the sized frame, before it's put on a canvas
+		if err := i.adjust(sz); err != nil {
+			return monitor.err(err)
+		}
+
+		// If we have a canvas we put the image on it, at its gravity.
+		done := i.mw
+		size := imgry.NewRect(int(i.mw.GetImageWidth()), int(i.mw.GetImageHeight()))
+		if cs, origin := sz.CalcCanvas(size); cs != nil {
+			if canvas == nil {
+				canvas = imagick.NewMagickWand()
+				bg = imagick.NewPixelWand()
+				bg.SetColor(pixelColor(fill))
+			}
+			canvas.NewImage(uint(cs.Width), uint(cs.Height), bg)
 			canvas.SetImageBackgroundColor(bg)
 			canvas.SetImageFormat(i.mw.GetImageFormat())
 
-			x := (sz.Canvas.Width - int(i.mw.GetImageWidth())) / 2
-			y := (sz.Canvas.Height - int(i.mw.GetImageHeight())) / 2
-			canvas.CompositeImage(i.mw, imagick.COMPOSITE_OP_OVER, true, x, y)
+			canvas.CompositeImage(i.mw, imagick.COMPOSITE_OP_OVER, true, origin.X, origin.Y)
 			canvas.ResetImagePage("")
+			done = canvas
+		}
+
+		// Put the text and the watermark on the finished frame
+		if sz.Text != nil {
+			if err := drawText(done, sz); err != nil {
+				return monitor.err(err)
+			}
+		}
+		if wm != nil {
+			if err := watermark(done, wm, wmSize, sz); err != nil {
+				return monitor.err(err)
+			}
 		}
 
 		if sz.Flatten {
@@ -359,24 +730,30 @@ func (i *Image) WriteToFile(fn string) error {
 	return err
 }
 
+func (i *Image) blob(flatten bool) []byte {
+	if flatten {
+		return i.mw.GetImageBlob()
+	}
+	return i.mw.GetImagesBlob()
+}
+
+// sync updates the image details from the wand and drops the encoded data,
+// which will be produced again the next time it's needed.
 func (i *Image) sync(optFlatten ...bool) error {
 	if i.Released() {
 		return ErrEngineReleased
 	}
 
-	var flatten bool
 	if len(optFlatten) > 0 {
-		flatten = optFlatten[0]
-	}
-
-	if flatten {
-		i.data = i.mw.GetImageBlob()
-	} else {
-		i.data = i.mw.GetImagesBlob()
+		i.flatten = optFlatten[0]
 	}
+	i.data = nil
 
 	i.width = int(i.mw.GetImageWidth())
 	i.height = int(i.mw.GetImageHeight())
+	if swapsSides(i.mw.GetImageOrientation()) {
+		i.width, i.height = i.height, i.width
+	}
 
 	i.format = strings.ToLower(i.mw.GetImageFormat())
 	if i.format == "jpeg" {
@@ -385,3 +762,150 @@ func (i *Image) sync(optFlatten ...bool) error {
 
 	return nil
 }
+
+// swapsSides reports whether an image of orientation o is displayed with
+// its width and height swapped.
+func swapsSides(o imagick.OrientationType) bool {
+	switch o {
+	case imagick.ORIENTATION_LEFT_TOP, imagick.ORIENTATION_RIGHT_TOP,
+		imagick.ORIENTATION_RIGHT_BOTTOM, imagick.ORIENTATION_LEFT_BOTTOM:
+		return true
+	default:
+		return false
+	}
+}
+
+// focalPoint finds the focal point of the current frame of mw on a small
+// grayscale copy of it.
+func focalPoint(mw *imagick.MagickWand) (*imgry.FloatPoint, error) {
+	small := mw.GetImage()
+	defer small.Destroy()
+
+	// A sample of 64px is plenty to find the edges in
+	w, h := small.GetImageWidth(), small.GetImageHeight()
+	if w > 64 || h > 64 {
+		if w > h {
+			w, h = 64, h*64/w+1
+		} else {
+			w, h = w*64/h+1, 64
+		}
+		if err := small.ScaleImage(w, h); err != nil {
+			return nil, err
+		}
+	}
+
+	px, err := small.ExportImagePixels(0, 0, w, h, "I", imagick.PIXEL_CHAR)
+	if err != nil {
+		return nil, err
+	}
+	gray := &image.Gray{Pix: px.([]byte), Stride: int(w), Rect: image.Rect(0, 0, int(w), int(h))}
+	return imgry.AutoFocalPoint(gray), nil
+}
+
+// watermark composites wm, an overlay of origSize, onto the current image
+// of dst the way the sizing says. The overlay is scaled in place, once.
+func watermark(dst, wm *imagick.MagickWand, origSize *imgry.Rect, sz *imgry.Sizing) error {
+	size := imgry.NewRect(int(dst.GetImageWidth()), int(dst.GetImageHeight()))
+	scaled, origin := sz.CalcWatermark(size, origSize)
+	if uint(scaled.Width) != wm.GetImageWidth() || uint(scaled.Height) != wm.GetImageHeight() {
+		if err := wm.ResizeImage(uint(scaled.Width), uint(scaled.Height), imagick.FILTER_LANCZOS); err != nil {
+			return err
+		}
+	}
+
+	if alpha := sz.Watermark.Alpha; alpha < 1 {
+		// Dissolving takes the opacity of the overlay as a percentage
+		dst.SetImageArtifact("compose:args", strconv.FormatFloat(alpha*100, 'f', -1, 64))
+		defer dst.DeleteImageArtifact("compose:args")
+		return dst.CompositeImage(wm, imagick.COMPOSITE_OP_DISSOLVE, true, origin.X, origin.Y)
+	}
+	return dst.CompositeImage(wm, imagick.COMPOSITE_OP_OVER, true, origin.X, origin.Y)
+}
+
+// The gravities of imgry.Gravities
+var gravityTypes = map[string]imagick.GravityType{
+	"center": imagick.GRAVITY_CENTER,
+	"n":      imagick.GRAVITY_NORTH,
+	"ne":     imagick.GRAVITY_NORTH_EAST,
+	"e":      imagick.GRAVITY_EAST,
+	"se":     imagick.GRAVITY_SOUTH_EAST,
+	"s":      imagick.GRAVITY_SOUTH,
+	"sw":     imagick.GRAVITY_SOUTH_WEST,
+	"w":      imagick.GRAVITY_WEST,
+	"nw":     imagick.GRAVITY_NORTH_WEST,
+}
+
+// drawText draws the text of the sizing onto the current image of dst,
+// wrapped to its width, over a box or with a shadow under it.
+func drawText(dst *imagick.MagickWand, sz *imgry.Sizing) error {
+	txt := sz.Text
+
+	dw := imagick.NewDrawingWand()
+	defer dw.Destroy()
+	pw := imagick.NewPixelWand()
+	defer pw.Destroy()
+
+	if txt.FontFile != "" {
+		if err := dw.SetFont(txt.FontFile); err != nil {
+			return err
+		}
+	}
+	size := sz.ScaledTextSize()
+	dw.SetFontSize(size)
+	dw.SetGravity(gravityTypes[txt.Gravity])
+	dw.SetTextAntialias(true)
+
+	width := txt.Width * float64(dst.GetImageWidth())
+	lines := imgry.WrapText(txt.Text, width, func(s string) float64 {
+		if fm := dst.QueryFontMetrics(dw, s); fm != nil {
+			return fm.TextWidth
+		}
+		return 0
+	})
+	text := strings.Join(lines, "\n")
+
+	// Offsets are taken inwards from the edges of the gravity, the text is
+	// kept half a line away from those it's put against
+	var x, y float64
+	switch txt.Gravity {
+	case "nw", "w", "sw", "ne", "e", "se":
+		x = size / 2
+	}
+	switch txt.Gravity {
+	case "nw", "n", "ne", "sw", "s", "se":
+		y = size / 2
+	}
+
+	if txt.Box != nil {
+		box := imagick.NewPixelWand()
+		defer box.Destroy()
+		box.SetColor(pixelColor(*txt.Box))
+		dw.SetTextUnderColor(box)
+	} else {
+		// A shadow down and to the right, which is inwards from the edges
+		// of the east and south gravities
+		dx, dy := math.Max(1, size/16), math.Max(1, size/16)
+		switch txt.Gravity {
+		case "ne", "e", "se":
+			dx = -dx
+		}
+		switch txt.Gravity {
+		case "sw", "s", "se":
+			dy = -dy
+		}
+		pw.SetColor("rgba(0,0,0,0.6)")
+		dw.SetFillColor(pw)
+		if err := dst.AnnotateImage(dw, x+dx, y+dy, 0, text); err != nil {
+			return err
+		}
+	}
+
+	pw.SetColor(pixelColor(txt.Color))
+	dw.SetFillColor(pw)
+	return dst.AnnotateImage(dw, x, y, 0, text)
+}
+
+// pixelColor returns c the way ImageMagick takes colors.
+func pixelColor(c color.NRGBA) string {
+	return fmt.Sprintf("rgba(%d,%d,%d,%g)", c.R, c.G, c.B, float64(c.A)/255)
+}
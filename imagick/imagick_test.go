@@ -1,9 +1,17 @@
 package imagick
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
 	"io/ioutil"
+	"os"
 	"testing"
+	"time"
 
 	"github.com/pressly/imgry"
 	"github.com/stretchr/testify/assert"
@@ -14,12 +22,12 @@ func TestLoadBlob(t *testing.T) {
 	assert.NoError(t, err)
 
 	ng := Engine{}
-	im, err := ng.LoadBlob(tdImage1)
+	im, err := ng.LoadBlob(context.Background(), tdImage1)
 	assert.NoError(t, err)
 	defer im.Release()
 
 	sz, _ := imgry.NewSizingFromQuery("size=800x")
-	err = im.SizeIt(sz)
+	err = im.SizeIt(context.Background(), sz)
 	assert.NoError(t, err)
 
 	im2Path := "/tmp/image1.jpg"
@@ -35,6 +43,31 @@ func TestLoadBlob(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestDataKeepsSource(t *testing.T) {
+	tdImage, err := ioutil.ReadFile("../testdata/image1.jpg")
+	assert.NoError(t, err)
+
+	ng := Engine{}
+	im, err := ng.LoadBlob(context.Background(), tdImage)
+	assert.NoError(t, err)
+	defer im.Release()
+
+	// Until the image is changed, its data is the source blob
+	assert.Equal(t, 1600, im.Width())
+	assert.Equal(t, tdImage, im.Data())
+
+	sz, _ := imgry.NewSizingFromQuery("size=400x&format=png")
+	err = im.SizeIt(context.Background(), sz)
+	assert.NoError(t, err)
+
+	im2, err := ng.LoadBlob(context.Background(), im.Data())
+	assert.NoError(t, err)
+	defer im2.Release()
+
+	assert.Equal(t, 400, im2.Width())
+	assert.Equal(t, "png", im2.Format())
+}
+
 func TestGetImageInfo(t *testing.T) {
 	tdImage1, err := ioutil.ReadFile("../testdata/image1.jpg")
 	assert.NoError(t, err)
@@ -47,6 +80,14 @@ func TestGetImageInfo(t *testing.T) {
 	assert.Equal(t, imfo.Height, 1200)
 	assert.True(t, float64(int(imfo.AspectRatio*1000))/1000 == 1.333)
 	assert.True(t, imfo.ContentLength == 451317)
+	assert.Equal(t, 1, imfo.Frames)
+
+	tdImage2, err := ioutil.ReadFile("../testdata/issue-8.gif")
+	assert.NoError(t, err)
+
+	imfo, err = ng.GetImageInfo(tdImage2)
+	assert.NoError(t, err)
+	assert.Equal(t, 27, imfo.Frames)
 }
 
 func TestIssue8GIFResize(t *testing.T) {
@@ -62,8 +103,12 @@ func TestIssue8GIFResize(t *testing.T) {
 	assert.Equal(t, 131, img.Width())
 	assert.Equal(t, 133, img.Height())
 
+	// Until the image is changed, its data is the source blob itself rather
+	// than the source encoded again
+	fi, err := os.Stat("../testdata/issue-8.gif")
+	assert.NoError(t, err)
 	origSize := len(img.Data())
-	assert.Equal(t, 393324, origSize)
+	assert.Equal(t, int(fi.Size()), origSize)
 
 	img.Release()
 
@@ -72,7 +117,7 @@ func TestIssue8GIFResize(t *testing.T) {
 	assert.NoError(t, err)
 
 	sz, _ = imgry.NewSizingFromQuery("size=750x")
-	err = img.SizeIt(sz)
+	err = img.SizeIt(context.Background(), sz)
 	assert.NoError(t, err)
 
 	assert.Equal(t, 750, img.Width())
@@ -94,7 +139,7 @@ func TestIssue8GIFResize(t *testing.T) {
 	assert.NoError(t, err)
 
 	sz, _ = imgry.NewSizingFromQuery("size=500x")
-	err = img.SizeIt(sz)
+	err = img.SizeIt(context.Background(), sz)
 	assert.NoError(t, err)
 
 	assert.Equal(t, 500, img.Width())
@@ -112,7 +157,7 @@ func TestIssue8GIFResize(t *testing.T) {
 	assert.NoError(t, err)
 
 	sz, _ = imgry.NewSizingFromQuery("size=900x")
-	err = img.SizeIt(sz)
+	err = img.SizeIt(context.Background(), sz)
 	assert.NoError(t, err)
 
 	assert.Equal(t, 900, img.Width())
@@ -130,7 +175,7 @@ func TestIssue8GIFResize(t *testing.T) {
 	assert.NoError(t, err)
 
 	sz, _ = imgry.NewSizingFromQuery("size=200x")
-	err = img.SizeIt(sz)
+	err = img.SizeIt(context.Background(), sz)
 	assert.NoError(t, err)
 
 	assert.Equal(t, 200, img.Width())
@@ -148,7 +193,7 @@ func TestIssue8GIFResize(t *testing.T) {
 	assert.NoError(t, err)
 
 	sz, _ = imgry.NewSizingFromQuery("size=150x")
-	err = img.SizeIt(sz)
+	err = img.SizeIt(context.Background(), sz)
 	assert.NoError(t, err)
 
 	assert.Equal(t, 150, img.Width())
@@ -185,7 +230,7 @@ func TestIssue10OpFittedJPEG(t *testing.T) {
 	portrait(func(img imgry.Image) (err error) {
 		// Note that we scale the image to 200 first.
 		sz, _ := imgry.NewSizingFromQuery("size=200x&canvas=320x200&op=fitted")
-		err = img.SizeIt(sz)
+		err = img.SizeIt(context.Background(), sz)
 		assert.NoError(t, err)
 
 		assert.Equal(t, 320, img.Width())
@@ -200,7 +245,7 @@ func TestIssue10OpFittedJPEG(t *testing.T) {
 	// Larger canvas
 	portrait(func(img imgry.Image) (err error) {
 		sz, _ := imgry.NewSizingFromQuery("size=150x&canvas=200x350&op=fitted")
-		err = img.SizeIt(sz)
+		err = img.SizeIt(context.Background(), sz)
 		assert.NoError(t, err)
 
 		assert.Equal(t, 200, img.Width())
@@ -232,7 +277,7 @@ func TestIssue10OpFittedJPEG(t *testing.T) {
 	// Smaller canvas
 	landscape(func(img imgry.Image) (err error) {
 		sz, _ := imgry.NewSizingFromQuery("size=200x&canvas=150x150&op=fitted")
-		err = img.SizeIt(sz)
+		err = img.SizeIt(context.Background(), sz)
 		assert.NoError(t, err)
 
 		assert.Equal(t, 150, img.Width())
@@ -247,7 +292,7 @@ func TestIssue10OpFittedJPEG(t *testing.T) {
 	// Larger canvas
 	landscape(func(img imgry.Image) (err error) {
 		sz, _ := imgry.NewSizingFromQuery("size=320x&canvas=380x340&op=fitted")
-		err = img.SizeIt(sz)
+		err = img.SizeIt(context.Background(), sz)
 		assert.NoError(t, err)
 
 		assert.Equal(t, 380, img.Width())
@@ -284,7 +329,7 @@ func TestIssue10OpFittedPNG(t *testing.T) {
 	testimage(func(img imgry.Image) (err error) {
 		// Note that we scale the image to 200 first.
 		sz, _ := imgry.NewSizingFromQuery("size=200x&canvas=150x120&op=fitted")
-		err = img.SizeIt(sz)
+		err = img.SizeIt(context.Background(), sz)
 		assert.NoError(t, err)
 
 		assert.Equal(t, 150, img.Width())
@@ -299,7 +344,7 @@ func TestIssue10OpFittedPNG(t *testing.T) {
 	// Larger canvas
 	testimage(func(img imgry.Image) (err error) {
 		sz, _ := imgry.NewSizingFromQuery("size=600x&canvas=650x650&op=fitted")
-		err = img.SizeIt(sz)
+		err = img.SizeIt(context.Background(), sz)
 		assert.NoError(t, err)
 
 		assert.Equal(t, 650, img.Width())
@@ -314,7 +359,7 @@ func TestIssue10OpFittedPNG(t *testing.T) {
 	// Larger resize
 	testimage(func(img imgry.Image) (err error) {
 		sz, _ := imgry.NewSizingFromQuery("size=800x&canvas=650x650&op=fitted")
-		err = img.SizeIt(sz)
+		err = img.SizeIt(context.Background(), sz)
 		assert.NoError(t, err)
 
 		assert.Equal(t, 650, img.Width())
@@ -351,7 +396,7 @@ func TestIssue10OpFittedGIF(t *testing.T) {
 	testimage(func(img imgry.Image) (err error) {
 		// Note that we scale the image to 200 first.
 		sz, _ := imgry.NewSizingFromQuery("size=200x&canvas=150x120&op=fitted")
-		err = img.SizeIt(sz)
+		err = img.SizeIt(context.Background(), sz)
 		assert.NoError(t, err)
 
 		assert.Equal(t, 150, img.Width())
@@ -366,7 +411,7 @@ func TestIssue10OpFittedGIF(t *testing.T) {
 	// Larger canvas
 	testimage(func(img imgry.Image) (err error) {
 		sz, _ := imgry.NewSizingFromQuery("size=48x&canvas=100x100&op=fitted")
-		err = img.SizeIt(sz)
+		err = img.SizeIt(context.Background(), sz)
 		assert.NoError(t, err)
 
 		assert.Equal(t, 100, img.Width())
@@ -381,7 +426,7 @@ func TestIssue10OpFittedGIF(t *testing.T) {
 	// Larger resize
 	testimage(func(img imgry.Image) (err error) {
 		sz, _ := imgry.NewSizingFromQuery("size=100x&canvas=200x200&op=fitted")
-		err = img.SizeIt(sz)
+		err = img.SizeIt(context.Background(), sz)
 		assert.NoError(t, err)
 
 		assert.Equal(t, 200, img.Width())
@@ -418,7 +463,7 @@ func TestIssue10OpFittedTestForLeaks(t *testing.T) {
 
 		testimage(func(img imgry.Image) (err error) {
 			sz, _ := imgry.NewSizingFromQuery("size=200x&canvas=150x120&op=fitted")
-			err = img.SizeIt(sz)
+			err = img.SizeIt(context.Background(), sz)
 			assert.NoError(t, err)
 
 			assert.Equal(t, 150, img.Width())
@@ -447,7 +492,7 @@ func TestIssue25(t *testing.T) {
 	assert.NoError(t, err)
 
 	sz, _ := imgry.NewSizingFromQuery("format=jpeg&size=750x922&op=cover")
-	err = img.SizeIt(sz)
+	err = img.SizeIt(context.Background(), sz)
 	assert.NoError(t, err)
 
 	assert.Equal(t, 750, img.Width())
@@ -458,3 +503,445 @@ func TestIssue25(t *testing.T) {
 
 	img.Release()
 }
+
+func TestOpPad(t *testing.T) {
+	ng := Engine{}
+
+	img, err := ng.LoadFile("../testdata/issue-25.jpg")
+	assert.NoError(t, err)
+	defer img.Release()
+
+	sz, _ := imgry.NewSizingFromQuery("size=400x400&op=pad&bg=ff0000&gravity=n")
+	err = img.SizeIt(context.Background(), sz)
+	assert.NoError(t, err)
+
+	assert.Equal(t, 400, img.Width())
+	assert.Equal(t, 400, img.Height())
+
+	// The image is at the top, padded with red below it
+	pw, err := img.(*Image).mw.GetImagePixelColor(200, 399)
+	assert.NoError(t, err)
+	assert.Equal(t, 1.0, pw.GetRed())
+	assert.Equal(t, 0.0, pw.GetGreen())
+	pw.Destroy()
+}
+
+func TestGravityAuto(t *testing.T) {
+	ng := Engine{}
+
+	img, err := ng.LoadFile("../testdata/issue-25.jpg")
+	assert.NoError(t, err)
+	defer img.Release()
+
+	sz, _ := imgry.NewSizingFromQuery("size=300x300&op=cover&gravity=auto")
+	err = img.SizeIt(context.Background(), sz)
+	assert.NoError(t, err)
+
+	assert.Equal(t, 300, img.Width())
+	assert.Equal(t, 300, img.Height())
+
+	// The engine found the focal point the crop is centered on
+	if assert.NotNil(t, sz.FocalPoint) {
+		assert.True(t, sz.FocalPoint.X >= 0 && sz.FocalPoint.X <= 1)
+		assert.True(t, sz.FocalPoint.Y >= 0 && sz.FocalPoint.Y <= 1)
+	}
+}
+
+// The orientation fixture is stored 80x40, red then blue, and turned 90°
+// clockwise by its EXIF, so it loads as 40x80 with red on top.
+const orientedFixture = "../testdata/orientation-6.jpg"
+
+func sizing(query string) *imgry.Sizing {
+	sz, _ := imgry.NewSizingFromQuery(query)
+	return sz
+}
+
+// sizeOriented loads the orientation fixture and sizes it by sz, the
+// caller releases the image.
+func sizeOriented(t *testing.T, sz *imgry.Sizing) imgry.Image {
+	img, err := Engine{}.LoadFile(orientedFixture)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assert.NoError(t, img.SizeIt(context.Background(), sz))
+	return img
+}
+
+// rgbAt returns the color at x,y of the image, each from 0 to 1.
+func rgbAt(t *testing.T, img imgry.Image, x, y int) (r, g, b float64) {
+	pw, err := img.(*Image).mw.GetImagePixelColor(x, y)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer pw.Destroy()
+	return pw.GetRed(), pw.GetGreen(), pw.GetBlue()
+}
+
+// shadeAt tells whether the pixel at x,y is "red", "blue" or neither.
+func shadeAt(t *testing.T, img imgry.Image, x, y int) string {
+	r, _, b := rgbAt(t, img, x, y)
+	switch {
+	case r > 0.75 && b < 0.25:
+		return "red"
+	case b > 0.75 && r < 0.25:
+		return "blue"
+	}
+	return ""
+}
+
+func TestOrientation(t *testing.T) {
+	tdImage, err := ioutil.ReadFile(orientedFixture)
+	assert.NoError(t, err)
+
+	imfo, err := Engine{}.GetImageInfo(tdImage)
+	assert.NoError(t, err)
+	assert.Equal(t, 40, imfo.Width)
+	assert.Equal(t, 80, imfo.Height)
+
+	img := sizeOriented(t, sizing("size=20x"))
+	defer img.Release()
+
+	assert.Equal(t, 20, img.Width())
+	assert.Equal(t, 40, img.Height())
+	assert.Equal(t, "red", shadeAt(t, img, 10, 5))
+
+	// orient=0 leaves the pixels as they are
+	img2 := sizeOriented(t, sizing("orient=0"))
+	defer img2.Release()
+
+	assert.Equal(t, 80, img2.Width())
+	assert.Equal(t, 40, img2.Height())
+}
+
+func TestSizeItCanceled(t *testing.T) {
+	ng := Engine{}
+
+	img, err := ng.LoadFile("../testdata/image1.jpg")
+	assert.NoError(t, err)
+	defer img.Release()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	sz, _ := imgry.NewSizingFromQuery("size=400x")
+	err = img.SizeIt(ctx, sz)
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, 1600, img.Width())
+
+	// The image is still usable after an aborted sizing
+	err = img.SizeIt(context.Background(), sz)
+	assert.NoError(t, err)
+	assert.Equal(t, 400, img.Width())
+}
+
+func TestResourceLimits(t *testing.T) {
+	ng := Engine{Limits: ResourceLimits{Memory: 256 * 1024 * 1024, Threads: 2}}
+	err := ng.Initialize("")
+	assert.NoError(t, err)
+
+	resources := ng.Resources()
+	assert.Equal(t, int64(256*1024*1024), resources["memory"].Limit)
+	assert.Equal(t, int64(2), resources["thread"].Limit)
+}
+
+func TestWandPool(t *testing.T) {
+	tdImage1, err := ioutil.ReadFile("../testdata/image1.jpg")
+	assert.NoError(t, err)
+
+	ng := Engine{Wands: NewWandPool(1)}
+
+	img, err := ng.LoadBlob(context.Background(), tdImage1)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, ng.Wands.InUse())
+
+	// The pool is full, so the next load waits until it gives up
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = ng.LoadBlob(ctx, tdImage1)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.Equal(t, 0, ng.Wands.Waiting())
+
+	// Clones don't wait, but count against the pool
+	img2 := img.(*Image).Clone()
+	assert.Equal(t, 2, ng.Wands.InUse())
+	img2.Release()
+	img2.Release()
+	assert.Equal(t, 1, ng.Wands.InUse())
+
+	// A waiting load gets the slot once the image is released
+	done := make(chan error)
+	go func() {
+		img3, err := ng.LoadBlob(context.Background(), tdImage1)
+		if err == nil {
+			img3.Release()
+		}
+		done <- err
+	}()
+	for ng.Wands.Waiting() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	img.Release()
+	assert.NoError(t, <-done)
+	assert.Equal(t, 0, ng.Wands.InUse())
+}
+
+func TestSizeMany(t *testing.T) {
+	ng := Engine{Wands: NewWandPool(2)}
+
+	img, err := ng.LoadFile("../testdata/issue-8.gif")
+	assert.NoError(t, err)
+	defer img.Release()
+
+	sz1, _ := imgry.NewSizingFromQuery("size=500x")
+	sz2, _ := imgry.NewSizingFromQuery("size=150x")
+
+	images, err := imgry.SizeMany(context.Background(), img, []*imgry.Sizing{sz1, sz2})
+	assert.NoError(t, err)
+	assert.Len(t, images, 2)
+
+	assert.Equal(t, 500, images[0].Width())
+	assert.Equal(t, 150, images[1].Width())
+	assert.Equal(t, 131, img.Width())
+
+	for _, im := range images {
+		im.Release()
+	}
+	assert.Equal(t, 1, ng.Wands.InUse())
+}
+
+func TestRotateFlip(t *testing.T) {
+	var tests = []struct {
+		query         string
+		width, height int
+		top           string
+	}{
+		{"rot=180", 40, 80, "blue"},
+		{"flip=v", 40, 80, "blue"},
+		{"flip=h", 40, 80, "red"},
+		{"rot=-90&size=40x", 40, 20, ""},
+	}
+
+	for _, tt := range tests {
+		img := sizeOriented(t, sizing(tt.query))
+
+		assert.Equal(t, tt.width, img.Width(), tt.query)
+		assert.Equal(t, tt.height, img.Height(), tt.query)
+		if tt.top != "" {
+			assert.Equal(t, tt.top, shadeAt(t, img, tt.width/2, 5), tt.query)
+		}
+		img.Release()
+	}
+
+	// Every frame of an animation is turned
+	img, err := Engine{}.LoadFile("../testdata/issue-8.gif")
+	assert.NoError(t, err)
+	defer img.Release()
+
+	sz, _ := imgry.NewSizingFromQuery("rot=90&flip=h")
+	err = img.SizeIt(context.Background(), sz)
+	assert.NoError(t, err)
+
+	assert.Equal(t, 460, img.Width())
+	assert.Equal(t, 817, img.Height())
+	assert.True(t, img.(*Image).mw.GetNumberImages() > 1)
+}
+
+func TestAdjust(t *testing.T) {
+	at := func(query string, x, y int) (r, g, b float64) {
+		img := sizeOriented(t, sizing(query))
+		defer img.Release()
+		return rgbAt(t, img, x, y)
+	}
+
+	r, g, b := at("gray=1", 20, 10)
+	assert.InDelta(t, r, g, 0.01, "gray")
+	assert.InDelta(t, g, b, 0.01, "gray")
+
+	r0, _, _ := at("size=40x", 20, 10)
+	r, _, _ = at("bri=-50", 20, 10)
+	assert.True(t, r < r0, "darker")
+
+	_, _, b = at("blur=5", 20, 38)
+	assert.True(t, b > 0.25, "blurred")
+}
+
+func TestResampling(t *testing.T) {
+	for _, query := range []string{"size=400x&g=1&filter=point", "size=400x&g=1&filter=box&usm=0,1,1,0.05"} {
+		img := sizeOriented(t, sizing(query))
+		assert.Equal(t, 400, img.Width(), query)
+		assert.Equal(t, 800, img.Height(), query)
+
+		// The edge between red and blue stays sharp
+		assert.Equal(t, "red", shadeAt(t, img, 200, 398), query)
+		img.Release()
+	}
+}
+
+func TestWatermark(t *testing.T) {
+	// A red square, showing on the blue bottom half
+	var buf bytes.Buffer
+	red := image.NewNRGBA(image.Rect(0, 0, 8, 8))
+	draw.Draw(red, red.Bounds(), image.NewUniform(color.NRGBA{0xff, 0, 0, 0xff}), image.ZP, draw.Src)
+	assert.NoError(t, png.Encode(&buf, red))
+
+	var tests = []struct {
+		query string
+		x, y  int
+		red   bool
+	}{
+		{"size=40x&wm=b/k&wm_scale=0.25", 35, 75, true},
+		{"size=40x&wm=b/k&wm_scale=0.25&wm_margin=10", 35, 75, false},
+		{"size=40x&wm=b/k&wm_scale=0.25&wm_margin=10", 25, 65, true},
+		{"size=40x&wm=b/k&wm_scale=0.25&wm_pos=sw", 5, 75, true},
+	}
+
+	for _, tt := range tests {
+		sz := sizing(tt.query)
+		sz.Watermark.Data = buf.Bytes()
+		img := sizeOriented(t, sz)
+
+		r, _, b := rgbAt(t, img, tt.x, tt.y)
+		assert.Equal(t, tt.red, r > b, tt.query)
+		img.Release()
+	}
+}
+
+func TestText(t *testing.T) {
+	for _, query := range []string{
+		"size=200x&txt=Hello+there+world&txt_size=20&txt_box=00ff00",
+		"size=200x&txt=Hello+there+world&txt_size=20&txt_pos=n&txt_color=00ff00",
+	} {
+		img := sizeOriented(t, sizing(query))
+		assert.Equal(t, 200, img.Width(), query)
+		assert.Equal(t, 400, img.Height(), query)
+
+		// Some green was drawn at the top or bottom
+		green := false
+		for y := 0; y < 400 && !green; y += 2 {
+			for x := 0; x < 200 && !green; x += 2 {
+				r, g, _ := rgbAt(t, img, x, y)
+				green = g > 0.75 && r < 0.25
+			}
+		}
+		assert.True(t, green, query)
+		img.Release()
+	}
+}
+
+func TestWebP(t *testing.T) {
+	ng := Engine{}
+
+	for _, query := range []string{"size=100x&format=webp", "size=100x&format=webp&lossless=1"} {
+		img, err := ng.LoadFile("../testdata/issue-8.gif")
+		assert.NoError(t, err)
+
+		sz, _ := imgry.NewSizingFromQuery(query)
+		err = img.SizeIt(context.Background(), sz)
+		assert.NoError(t, err)
+		assert.Equal(t, "webp", img.Format(), query)
+		assert.Equal(t, 100, img.Width(), query)
+		assert.Equal(t, "RIFF", string(img.Data()[:4]), query)
+		assert.Equal(t, "WEBP", string(img.Data()[8:12]), query)
+
+		// Still animated
+		info, err := ng.GetImageInfo(img.Data())
+		assert.NoError(t, err)
+		assert.True(t, info.Frames > 1, query)
+
+		img.Release()
+	}
+}
+
+func TestFormats(t *testing.T) {
+	ng := Engine{}
+	err := ng.Initialize("")
+	assert.NoError(t, err)
+
+	formats := ng.Formats()
+	assert.Contains(t, formats, "jpg")
+	assert.Contains(t, formats, "png")
+	assert.Contains(t, formats, "gif")
+
+	// The ones of the delegates ImageMagick was built with encode
+	for _, format := range []string{"avif", "jxl"} {
+		found := false
+		for _, f := range formats {
+			found = found || f == format
+		}
+		if !found {
+			continue
+		}
+
+		img, err := ng.LoadFile("../testdata/image1.jpg")
+		assert.NoError(t, err)
+
+		sz, _ := imgry.NewSizingFromQuery("size=100x&format=" + format)
+		err = img.SizeIt(context.Background(), sz)
+		assert.NoError(t, err, format)
+		assert.Equal(t, format, img.Format())
+		assert.NotEmpty(t, img.Data())
+
+		img.Release()
+	}
+}
+
+func TestAutoFormat(t *testing.T) {
+	ng := Engine{}
+
+	var tests = []struct {
+		file   string
+		format string
+	}{
+		{"../testdata/gophers.png", "jpg"},
+		{"../testdata/image1.jpg", "jpg"},
+		{"../testdata/issue-8.gif", "gif"},
+	}
+	for _, tt := range tests {
+		img, err := ng.LoadFile(tt.file)
+		assert.NoError(t, err)
+
+		sz, _ := imgry.NewSizingFromQuery("size=100x&format=auto")
+		err = img.SizeIt(context.Background(), sz)
+		assert.NoError(t, err, tt.file)
+		assert.Equal(t, tt.format, img.Format(), tt.file)
+
+		img.Release()
+	}
+}
+
+func TestFlattenAlpha(t *testing.T) {
+	ng := Engine{}
+
+	// Transparent all over
+	var buf bytes.Buffer
+	assert.NoError(t, png.Encode(&buf, image.NewNRGBA(image.Rect(0, 0, 64, 64))))
+	tdImage := buf.Bytes()
+
+	var tests = []struct {
+		query   string
+		x, y    int
+		r, g, b float64
+	}{
+		{"format=jpg", 8, 8, 1, 1, 1},
+		{"format=jpg&bg=ff0000", 8, 8, 1, 0, 0},
+		{"size=32x32&canvas=64x64&format=jpg&bg=0000ff", 2, 2, 0, 0, 1},
+	}
+	for _, tt := range tests {
+		img, err := ng.LoadBlob(context.Background(), tdImage)
+		assert.NoError(t, err)
+
+		sz, _ := imgry.NewSizingFromQuery(tt.query)
+		err = img.SizeIt(context.Background(), sz)
+		assert.NoError(t, err, tt.query)
+
+		pw, err := img.(*Image).mw.GetImagePixelColor(tt.x, tt.y)
+		assert.NoError(t, err)
+		assert.InDelta(t, tt.r, pw.GetRed(), 0.1, tt.query)
+		assert.InDelta(t, tt.g, pw.GetGreen(), 0.1, tt.query)
+		assert.InDelta(t, tt.b, pw.GetBlue(), 0.1, tt.query)
+		assert.InDelta(t, 1, pw.GetAlpha(), 0.01, tt.query)
+		pw.Destroy()
+
+		img.Release()
+	}
+}
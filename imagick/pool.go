@@ -0,0 +1,133 @@
+package imagick
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/goware/go-metrics"
+)
+
+// WandPool is a counted pool of slots bounding the number of images, and
+// so of MagickWands, that are alive at once. Loading an image waits for a
+// free slot, and Release returns it.
+type WandPool struct {
+	size int
+
+	mu      sync.Mutex
+	used    int
+	waiters []chan struct{}
+}
+
+// NewWandPool returns a pool of size slots, or nil for an unbounded pool
+// when size is zero or less.
+func NewWandPool(size int) *WandPool {
+	if size <= 0 {
+		return nil
+	}
+	return &WandPool{size: size}
+}
+
+// InUse returns the number of slots taken.
+func (p *WandPool) InUse() int {
+	if p == nil {
+		return 0
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.used
+}
+
+// Waiting returns the number of loads waiting for a slot.
+func (p *WandPool) Waiting() int {
+	if p == nil {
+		return 0
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.waiters)
+}
+
+// acquire waits for a free slot, first come first served, until the
+// context is done.
+func (p *WandPool) acquire(ctx context.Context) error {
+	if p == nil {
+		return nil
+	}
+
+	p.mu.Lock()
+	if p.used < p.size && len(p.waiters) == 0 {
+		p.used++
+		p.mu.Unlock()
+		p.gauge()
+		return nil
+	}
+	ready := make(chan struct{})
+	p.waiters = append(p.waiters, ready)
+	p.mu.Unlock()
+
+	defer metrics.MeasureSince([]string{"fn.imagick.WaitForWand"}, time.Now())
+	p.gauge()
+
+	select {
+	case <-ready:
+		// The slot was handed over by release
+		p.gauge()
+		return nil
+	case <-ctx.Done():
+	}
+
+	p.mu.Lock()
+	for n, ch := range p.waiters {
+		if ch == ready {
+			p.waiters = append(p.waiters[:n], p.waiters[n+1:]...)
+			p.mu.Unlock()
+			p.gauge()
+			metrics.IncrCounter([]string{"fn.imagick.WandTimeouts"}, 1)
+			return ctx.Err()
+		}
+	}
+	p.mu.Unlock()
+
+	// We were handed a slot just as the context was done, give it back
+	p.release()
+	metrics.IncrCounter([]string{"fn.imagick.WandTimeouts"}, 1)
+	return ctx.Err()
+}
+
+// add takes a slot without waiting, even if that goes over the size of
+// the pool. It's meant for images derived from one already holding a slot,
+// where waiting could deadlock.
+func (p *WandPool) add() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	p.used++
+	p.mu.Unlock()
+	p.gauge()
+}
+
+// release returns a slot, handing it to the oldest waiter if any.
+func (p *WandPool) release() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	if len(p.waiters) > 0 && p.used <= p.size {
+		close(p.waiters[0])
+		p.waiters = p.waiters[1:]
+	} else {
+		p.used--
+	}
+	p.mu.Unlock()
+	p.gauge()
+}
+
+func (p *WandPool) gauge() {
+	p.mu.Lock()
+	used, waiting := p.used, len(p.waiters)
+	p.mu.Unlock()
+	metrics.SetGauge([]string{"fn.imagick.WandsInUse"}, float32(used))
+	metrics.SetGauge([]string{"fn.imagick.WandWaiters"}, float32(waiting))
+}
@@ -0,0 +1,7 @@
+#include <stdint.h>
+#include <MagickWand/MagickWand.h>
+#include "_cgo_export.h"
+
+void imgrySetProgressMonitor(MagickWand *wand, uintptr_t id) {
+	MagickSetImageProgressMonitor(wand, (MagickProgressMonitor)imgryProgressMonitor, (void *)id);
+}
@@ -0,0 +1,93 @@
+package imagick
+
+/*
+#cgo !no_pkgconfig pkg-config: MagickWand MagickCore
+#include <stdint.h>
+#include <MagickWand/MagickWand.h>
+
+extern void imgrySetProgressMonitor(MagickWand *wand, uintptr_t id);
+*/
+import "C"
+
+import (
+	"context"
+	"sync"
+	"unsafe"
+
+	"gopkg.in/gographics/imagick.v3/imagick"
+)
+
+// ImageMagick reports the progress of its long running operations (resize,
+// crop, composite...) to a monitor, which may abort the operation by
+// returning false. We use it to stop the work as soon as the context of a
+// sizing is done. Monitors are only known to C by their id, so a stale id
+// left on an image is harmless.
+var progress = struct {
+	sync.RWMutex
+	seq      uintptr
+	monitors map[uintptr]*progressMonitor
+}{monitors: map[uintptr]*progressMonitor{}}
+
+type progressMonitor struct {
+	id  uintptr
+	ctx context.Context
+}
+
+func watchProgress(ctx context.Context) *progressMonitor {
+	m := &progressMonitor{ctx: ctx}
+	if ctx.Done() == nil {
+		// The context can never be canceled, nothing to watch
+		return m
+	}
+
+	progress.Lock()
+	progress.seq++
+	m.id = progress.seq
+	progress.monitors[m.id] = m
+	progress.Unlock()
+	return m
+}
+
+// attach sets the monitor on the current image of the wand.
+func (m *progressMonitor) attach(mw *imagick.MagickWand) {
+	if m.id == 0 {
+		return
+	}
+	C.imgrySetProgressMonitor(cWand(mw), C.uintptr_t(m.id))
+}
+
+func (m *progressMonitor) stop() {
+	if m.id == 0 {
+		return
+	}
+	progress.Lock()
+	delete(progress.monitors, m.id)
+	progress.Unlock()
+}
+
+// err returns the context error in place of the error of an operation
+// that was aborted by the monitor.
+func (m *progressMonitor) err(err error) error {
+	if ctxErr := m.ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	return err
+}
+
+// cWand returns the underlying C wand, which is the first field of the
+// vendored imagick.MagickWand.
+func cWand(mw *imagick.MagickWand) *C.MagickWand {
+	return *(**C.MagickWand)(unsafe.Pointer(mw))
+}
+
+//export imgryProgressMonitor
+func imgryProgressMonitor(text *C.char, offset C.MagickOffsetType, span C.MagickSizeType, clientData unsafe.Pointer) C.MagickBooleanType {
+	progress.RLock()
+	m, ok := progress.monitors[uintptr(clientData)]
+	progress.RUnlock()
+
+	if ok && m.ctx.Err() != nil {
+		return C.MagickFalse
+	}
+	return C.MagickTrue
+}
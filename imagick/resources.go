@@ -0,0 +1,82 @@
+package imagick
+
+import (
+	"gopkg.in/gographics/imagick.v3/imagick"
+)
+
+// ResourceLimits of ImageMagick, a zero value keeps the ImageMagick default
+// for that resource. Once the memory and map limits are reached pixels are
+// cached on disk, in the engine tmpDir, up to the disk limit.
+//
+// The time resource of ImageMagick isn't one of them, it counts the life of
+// the whole process. Sizings are bounded by their context instead.
+type ResourceLimits struct {
+	Memory  int64 // bytes
+	Map     int64 // bytes
+	Disk    int64 // bytes
+	Area    int64 // pixels of a single image
+	Threads int64
+}
+
+// Resource is the current usage of an ImageMagick resource and its limit,
+// in the units of ResourceLimits.
+type Resource struct {
+	Usage int64 `json:"usage"`
+	Limit int64 `json:"limit"`
+}
+
+var resourceTypes = map[string]imagick.ResourceType{
+	"memory": imagick.RESOURCE_MEMORY,
+	"map":    imagick.RESOURCE_MAP,
+	"disk":   imagick.RESOURCE_DISK,
+	"area":   imagick.RESOURCE_AREA,
+	"thread": imagick.RESOURCE_THREAD,
+	"file":   imagick.RESOURCE_FILE,
+}
+
+func (l ResourceLimits) apply() error {
+	limits := []struct {
+		rtype imagick.ResourceType
+		limit int64
+	}{
+		{imagick.RESOURCE_MEMORY, l.Memory},
+		{imagick.RESOURCE_MAP, l.Map},
+		{imagick.RESOURCE_DISK, l.Disk},
+		{imagick.RESOURCE_AREA, l.Area},
+		{imagick.RESOURCE_THREAD, l.Threads},
+	}
+
+	// The limits are global to ImageMagick, the wand is only needed
+	// to reach the API.
+	mw := imagick.NewMagickWand()
+	defer mw.Destroy()
+
+	for _, r := range limits {
+		if r.limit <= 0 {
+			continue
+		}
+		if err := mw.SetResourceLimit(r.rtype, r.limit); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Resources returns the current usage and limit of the ImageMagick
+// resources, keyed by name, along with the slots of the wand pool.
+func (ng Engine) Resources() map[string]Resource {
+	resources := make(map[string]Resource, len(resourceTypes)+1)
+	for name, rtype := range resourceTypes {
+		resources[name] = Resource{
+			Usage: imagick.GetResource(rtype),
+			Limit: imagick.GetResourceLimit(rtype),
+		}
+	}
+	if ng.Wands != nil {
+		resources["wands"] = Resource{
+			Usage: int64(ng.Wands.InUse()),
+			Limit: int64(ng.Wands.size),
+		}
+	}
+	return resources
+}
@@ -1,6 +1,14 @@
 package imgry
 
-import "errors"
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+)
 
 const (
 	VERSION = "1.1.0"
@@ -8,18 +16,78 @@ const (
 
 var (
 	ErrInvalidImageData = errors.New("invalid image data")
+	ErrEmptyCropBox     = errors.New("crop box has no pixels of the image")
 )
 
+// EngineFactory returns a new engine, yet to be initialized.
+type EngineFactory func() Engine
+
+var engines = struct {
+	sync.RWMutex
+	factories map[string]EngineFactory
+}{factories: map[string]EngineFactory{}}
+
+// RegisterEngine makes an engine available by name, it's meant to be
+// called from the init function of the engine package. Registering the
+// same name twice panics.
+func RegisterEngine(name string, factory EngineFactory) {
+	engines.Lock()
+	defer engines.Unlock()
+
+	if factory == nil {
+		panic("imgry: RegisterEngine factory is nil")
+	}
+	if _, dup := engines.factories[name]; dup {
+		panic("imgry: RegisterEngine called twice for engine " + name)
+	}
+	engines.factories[name] = factory
+}
+
+// NewEngine returns a new engine of the registered name.
+func NewEngine(name string) (Engine, error) {
+	engines.RLock()
+	factory, ok := engines.factories[name]
+	engines.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("imgry: unknown engine %q (forgotten import?)", name)
+	}
+	return factory(), nil
+}
+
+// Engines returns the sorted names of the registered engines.
+func Engines() []string {
+	engines.RLock()
+	defer engines.RUnlock()
+
+	names := make([]string, 0, len(engines.factories))
+	for name := range engines.factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
 type Engine interface {
 	Version() string
 	Initialize(tmpDir string) error
+	Formats() []string // output formats it can encode, known after Initialize
 	Terminate()
 
 	LoadFile(filename string, srcFormat ...string) (Image, error)
-	LoadBlob(b []byte, srcFormat ...string) (Image, error)
+	LoadBlob(ctx context.Context, b []byte, srcFormat ...string) (Image, error)
 	GetImageInfo(b []byte, srcFormat ...string) (*ImageInfo, error)
 }
 
+// DrawsText reports whether ng can draw the text of a sizing. The engines
+// that can have a DrawsText method saying so.
+func DrawsText(ng Engine) bool {
+	dt, ok := ng.(interface {
+		DrawsText() bool
+	})
+	return ok && dt.DrawsText()
+}
+
 type Image interface {
 	Data() []byte
 	Width() int
@@ -30,7 +98,8 @@ type Image interface {
 	Release()
 	Released() bool
 
-	SizeIt(sizing *Sizing) error
+	Clone() Image
+	SizeIt(ctx context.Context, sizing *Sizing) error
 	WriteToFile(string) error
 }
 
@@ -42,4 +111,45 @@ type ImageInfo struct {
 	Height        int     `json:"height"`
 	AspectRatio   float64 `json:"aspect_ratio"`
 	ContentLength int     `json:"content_length"`
+	Frames        int     `json:"frames"`
+}
+
+// SizeMany returns a sized clone of the image for each of the sizings, so
+// that several variants are made from a single decode. The image itself is
+// left as is. On error, the clones made so far are released.
+func SizeMany(ctx context.Context, im Image, sizings []*Sizing) ([]Image, error) {
+	images := make([]Image, 0, len(sizings))
+	for _, sz := range sizings {
+		im2 := im.Clone()
+		images = append(images, im2)
+
+		if err := im2.SizeIt(ctx, sz); err != nil {
+			for _, im2 := range images {
+				im2.Release()
+			}
+			return nil, err
+		}
+	}
+	return images, nil
+}
+
+// ReadAll reads from r until EOF, giving up as soon as the context is done.
+func ReadAll(ctx context.Context, r io.Reader) ([]byte, error) {
+	var buf bytes.Buffer
+	if _, err := buf.ReadFrom(&ctxReader{ctx, r}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (cr *ctxReader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cr.r.Read(p)
 }
@@ -0,0 +1,27 @@
+package imgry
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegisterEngine(t *testing.T) {
+	calls := 0
+	RegisterEngine("test", func() Engine {
+		calls++
+		return nil
+	})
+
+	_, err := NewEngine("test")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, calls)
+	assert.Contains(t, Engines(), "test")
+
+	_, err = NewEngine("unknown")
+	assert.Error(t, err)
+
+	assert.Panics(t, func() {
+		RegisterEngine("test", func() Engine { return nil })
+	})
+}
@@ -13,8 +13,9 @@ import (
 )
 
 var (
-	ErrImageNotFound   = errors.New("image not found")
-	ErrInvalidBucketID = errors.New("invalid bucket id - must be: [a-z0-9_:-] max-length: 40")
+	ErrImageNotFound     = errors.New("image not found")
+	ErrInvalidBucketID   = errors.New("invalid bucket id - must be: [a-z0-9_:-] max-length: 40")
+	ErrWatermarkNotFound = errors.New("watermark image not found")
 
 	BucketIDInvalidator = regexp.MustCompile(`(i?)[^a-z0-9\/_\-:\.]`)
 )
@@ -33,6 +34,11 @@ func NewBucket(id string) (*Bucket, error) {
 	return b, nil
 }
 
+// Returns the configured settings of the bucket
+func (b *Bucket) Config() BucketConfig {
+	return app.Config.Buckets[b.ID]
+}
+
 func (b *Bucket) ValidID() (bool, error) {
 	if b.ID == "" || len(b.ID) > 40 {
 		return false, ErrInvalidBucketID
@@ -62,7 +68,7 @@ func (b *Bucket) AddImagesFromUrls(ctx context.Context, urls []string) ([]*Image
 		defer images[i].Release()
 		if r.Status == 200 && len(r.Data) > 0 {
 			images[i].Data = r.Data
-			if err = images[i].LoadImage(); err != nil {
+			if err = images[i].LoadImage(ctx); err != nil {
 				lg.Errorf("LoadBlob data for %s returned error: %s", r.URL.String(), err)
 			}
 		}
@@ -71,6 +77,30 @@ func (b *Bucket) AddImagesFromUrls(ctx context.Context, urls []string) ([]*Image
 	return images, b.AddImages(ctx, images)
 }
 
+// Fetches a single image, reading the response body straight into the
+// image, and adds it to the bucket.
+func (b *Bucket) AddImageFromUrl(ctx context.Context, url string) (*Image, error) {
+	resp, body, err := app.Fetcher.Open(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	if resp.Status != 200 {
+		return nil, fmt.Errorf("fetching %s returned status %d", url, resp.Status)
+	}
+
+	im := NewImageFromSrcUrl(resp.URL.String())
+	defer im.Release()
+
+	if err := im.LoadImageReader(ctx, body); err != nil {
+		lg.Errorf("LoadImageReader data for %s returned error: %s", resp.URL.String(), err)
+		return nil, err
+	}
+
+	return im, b.AddImage(ctx, im)
+}
+
 // TODO: .. how do handle errors here... ? each image would
 // have it's own error .. should we put an Err on each image object...?
 // or return an errList ..
@@ -117,42 +147,119 @@ func (b *Bucket) GetImageSize(ctx context.Context, key string, sizing *imgry.Siz
 		return nil, err
 	}
 
-	// Calculate the sizing ahead of time so our query is updated
+	// The metadata of the original fills in what the sizing leaves out,
+	// which changes its query, and so the key of the size, along with it
+	origIm.ImageMeta.applyTo(sizing)
+
+	// Resolve the sizing ahead of time so our query is updated
 	// and we can find it in our db
-	sizing.CalcResizeRect(&imgry.Rect{origIm.Width, origIm.Height})
+	sizing.ResolveDPR(&imgry.Rect{Width: origIm.Width, Height: origIm.Height})
 	sizing.Size.Width = sizing.GranularizedWidth()
 	sizing.Size.Height = sizing.GranularizedHeight()
 
-	// Find the specific size
-	im, err := b.DbFindImage(ctx, key, sizing)
+	// Find the specific size. The focal point gets filled in below and by
+	// the engine, so the key is taken now and the new size is saved under
+	// it as well.
+	idxKey := b.DbIndexKey(key, sizing)
+	im, err := b.dbFindImage(ctx, idxKey)
 	if err != nil && err != ErrImageNotFound {
 		return nil, err
 	}
 	if im != nil { // Got it!
+		im.Alt = origIm.Alt
 		return im, nil
 	}
 
+	// Smart crops are centered on the focal point found when the image
+	// was first sized that way. It's the point of the whole image, so one
+	// found on turned or cropped frames is only good for their own size.
+	findFocalPoint := sizing.NeedsFocalPoint()
+	keepFocalPoint := findFocalPoint && !sizing.ReframesSource()
+	if keepFocalPoint && origIm.AutoFocalPoint != "" {
+		fp, err := imgry.NewFloatPointFromQuery(origIm.AutoFocalPoint)
+		if err == nil {
+			sizing.FocalPoint = fp
+			findFocalPoint = false
+		}
+	}
+
+	// Load the overlay of the watermark to go on the new size
+	if wm := sizing.Watermark; wm != nil {
+		if err := loadWatermark(ctx, wm); err != nil {
+			return nil, err
+		}
+	}
+
 	// Build a new size from the original
-	im2, err := origIm.MakeSize(sizing)
+	im2, err := origIm.MakeSize(ctx, sizing)
 	defer im2.Release()
 	if err != nil {
 		return nil, err
 	}
 
-	err = b.DbSaveImage(ctx, im2, sizing)
+	// Keep the focal point the engine found with the original
+	if keepFocalPoint && findFocalPoint && sizing.FocalPoint != nil {
+		origIm.AutoFocalPoint = sizing.FocalPoint.ToString()
+		if err := app.DB.HSet(b.DbIndexKey(key), origIm); err != nil {
+			lg.Warnf("Failed to save the focal point of %s cause: %s", key, err)
+		}
+	}
+
+	err = b.dbSaveImage(ctx, im2, idxKey)
+	im2.Alt = origIm.Alt
 	return im2, err
 }
 
+// Loads the overlay of a watermark, which is an original image of its bucket
+func loadWatermark(ctx context.Context, wm *imgry.Watermark) error {
+	id, key := wm.Location()
+	b, err := NewBucket(id)
+	if err != nil {
+		return err
+	}
+
+	im, err := b.DbFindImage(ctx, key, nil)
+	if err == ErrImageNotFound {
+		return ErrWatermarkNotFound
+	}
+	if err != nil {
+		return err
+	}
+	wm.Data = im.Data
+	return nil
+}
+
+// Stores the metadata of an original image, keeping the rest of its record
+func (b *Bucket) DbSaveImageMeta(ctx context.Context, key string, meta ImageMeta) (*Image, error) {
+	idxKey := b.DbIndexKey(key)
+
+	im := &Image{}
+	if err := app.DB.HGet(idxKey, im); err != nil {
+		return nil, err
+	}
+	if im.Key == "" {
+		return nil, ErrImageNotFound
+	}
+
+	im.ImageMeta = meta
+	if err := app.DB.HSet(idxKey, im); err != nil {
+		return nil, err
+	}
+	return im, nil
+}
+
 // Loads the image from our table+data store with optional sizing
 func (b *Bucket) DbFindImage(ctx context.Context, key string, optSizing ...*imgry.Sizing) (*Image, error) {
-	defer metrics.MeasureSince([]string{"fn.bucket.DbFindImage"}, time.Now())
-
 	var sizing *imgry.Sizing
 	if len(optSizing) > 0 { // sizing is optional
 		sizing = optSizing[0]
 	}
 
-	idxKey := b.DbIndexKey(key, sizing)
+	return b.dbFindImage(ctx, b.DbIndexKey(key, sizing))
+}
+
+func (b *Bucket) dbFindImage(ctx context.Context, idxKey string) (*Image, error) {
+	defer metrics.MeasureSince([]string{"fn.bucket.DbFindImage"}, time.Now())
 
 	im := &Image{}
 	err := app.DB.HGet(idxKey, im)
@@ -177,15 +284,17 @@ func (b *Bucket) DbFindImage(ctx context.Context, key string, optSizing ...*imgr
 }
 
 // Persists the image blob in our data store
-func (b *Bucket) DbSaveImage(ctx context.Context, im *Image, sizing *imgry.Sizing) (err error) {
+func (b *Bucket) DbSaveImage(ctx context.Context, im *Image, sizing *imgry.Sizing) error {
+	return b.dbSaveImage(ctx, im, b.DbIndexKey(im.Key, sizing))
+}
+
+func (b *Bucket) dbSaveImage(ctx context.Context, im *Image, idxKey string) (err error) {
 	defer metrics.MeasureSince([]string{"fn.bucket.DbSaveImage"}, time.Now())
 
 	if err := im.ValidateKey(); err != nil {
 		return err
 	}
 
-	idxKey := b.DbIndexKey(im.Key, sizing)
-
 	err = app.Chainstore.Put(context.Background(), idxKey, im.Data) // TODO
 	// err = app.Chainstore.Put(idxKey, im.Data)
 	if err != nil {
@@ -216,7 +325,13 @@ func (b *Bucket) DbIndexKey(imageKey string, optSizing ...*imgry.Sizing) string
 	}
 	key := fmt.Sprintf("%s/%s", b.ID, imageKey)
 	if sizing != nil {
-		key = fmt.Sprintf("%s:q/%s", key, sha1Hash(sizing.ToQuery().Encode()))
+		hash := sha1Hash
+		if sizing.Text != nil {
+			// Sizings with text are newer than sha1Hash, whose mangled
+			// escapes could have two texts share a key.
+			hash = sha1HashV2
+		}
+		key = fmt.Sprintf("%s:q/%s", key, hash(sizing.ToQuery().Encode()))
 	}
 	return key
 }
@@ -0,0 +1,158 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"testing"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/pressly/chainstore/memstore"
+	"github.com/pressly/imgry"
+	"github.com/pressly/imgry/imagex"
+	"github.com/stretchr/testify/assert"
+)
+
+// memRedis stands in for redis, with just the hashes the DB keeps images in
+type memRedis struct {
+	sync.Mutex
+	hashes map[string]map[string][]byte
+}
+
+func newMemDB() *DB {
+	r := &memRedis{hashes: map[string]map[string][]byte{}}
+	return &DB{pool: &redis.Pool{
+		Dial: func() (redis.Conn, error) { return memRedisConn{r}, nil },
+	}}
+}
+
+type memRedisConn struct {
+	r *memRedis
+}
+
+func (c memRedisConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	c.r.Lock()
+	defer c.r.Unlock()
+
+	switch cmd {
+	case "PING":
+		return "PONG", nil
+	case "DEL":
+		delete(c.r.hashes, args[0].(string))
+		return int64(1), nil
+	case "HGETALL":
+		var reply []interface{}
+		for k, v := range c.r.hashes[args[0].(string)] {
+			reply = append(reply, []byte(k), v)
+		}
+		return reply, nil
+	case "HMSET":
+		h := c.r.hashes[args[0].(string)]
+		if h == nil {
+			h = map[string][]byte{}
+			c.r.hashes[args[0].(string)] = h
+		}
+		for i := 1; i+1 < len(args); i += 2 {
+			h[args[i].(string)] = bulk(args[i+1])
+		}
+		return "OK", nil
+	}
+	return nil, fmt.Errorf("memRedis: unknown command %s", cmd)
+}
+
+// bulk formats v as redis would send it back
+func bulk(v interface{}) []byte {
+	switch v := v.(type) {
+	case []byte:
+		return v
+	case string:
+		return []byte(v)
+	case bool:
+		if v {
+			return []byte("1")
+		}
+		return []byte("0")
+	}
+	return []byte(fmt.Sprint(v))
+}
+
+func (c memRedisConn) Close() error                      { return nil }
+func (c memRedisConn) Err() error                        { return nil }
+func (c memRedisConn) Send(string, ...interface{}) error { return nil }
+func (c memRedisConn) Flush() error                      { return nil }
+func (c memRedisConn) Receive() (interface{}, error)     { return nil, nil }
+
+// loadCountEngine is the imagex engine, counting the images it loads
+type loadCountEngine struct {
+	imagex.Engine
+	n *int
+}
+
+func (ng loadCountEngine) LoadBlob(ctx context.Context, b []byte, srcFormat ...string) (imgry.Image, error) {
+	*ng.n++
+	return ng.Engine.LoadBlob(ctx, b, srcFormat...)
+}
+
+func TestGetImageSizeCached(t *testing.T) {
+	var loads int
+	store := memstore.New(100 * 1024 * 1024)
+	assert.NoError(t, store.Open())
+
+	conf := DefaultConfig
+	app = &Server{
+		Config:      &conf,
+		DB:          newMemDB(),
+		Chainstore:  store,
+		ImageEngine: loadCountEngine{n: &loads},
+	}
+
+	data, err := ioutil.ReadFile("../testdata/gophers.jpg")
+	assert.NoError(t, err)
+
+	b, err := NewBucket("test")
+	assert.NoError(t, err)
+
+	orig := &Image{Key: sha1Hash("gophers"), Data: data}
+	assert.NoError(t, orig.LoadImage(context.Background()))
+	assert.NoError(t, b.AddImage(context.Background(), orig))
+	orig.Release()
+
+	// Sizes the engine fills in the focal point of are found again all the same
+	for _, query := range []string{
+		"size=100x100&op=cover",
+		"size=100x100&op=balance",
+		"size=100x100&op=smart",
+		"size=100x100&op=smart&rot=90",
+		"size=100x100&op=smart&cb=0,0,0.5,0.5",
+	} {
+		var sizes [2][]byte
+		for i := range sizes {
+			loads = 0
+			sz, err := imgry.NewSizingFromQuery(query)
+			assert.NoError(t, err)
+
+			im, err := b.GetImageSize(context.Background(), orig.Key, sz)
+			assert.NoError(t, err, query)
+			sizes[i] = im.Data
+		}
+		assert.Equal(t, 0, loads, "%s isn't cached", query)
+		assert.Equal(t, sizes[0], sizes[1], query)
+	}
+}
+
+func TestDbIndexKeyText(t *testing.T) {
+	b, err := NewBucket("test")
+	assert.NoError(t, err)
+
+	key := func(query string) string {
+		sz, err := imgry.NewSizingFromQuery(query)
+		assert.NoError(t, err)
+		return b.DbIndexKey("abc", sz)
+	}
+	assert.NotEqual(t, key("size=100x&txt=a,b"), key("size=100x&txt=a<b"))
+
+	// Sizings without text keep their stored keys
+	sz, _ := imgry.NewSizingFromQuery("size=100x&fp=0.2,0.3")
+	assert.Equal(t, "test/abc:q/"+sha1Hash(sz.ToQuery().Encode()), key("size=100x&fp=0.2,0.3"))
+}
@@ -19,6 +19,8 @@ import (
 	"github.com/pressly/chainstore/memstore"
 	"github.com/pressly/chainstore/metricsmgr"
 	"github.com/pressly/chainstore/s3store"
+	"github.com/pressly/imgry"
+	"github.com/pressly/imgry/imagick"
 )
 
 type Config struct {
@@ -29,6 +31,16 @@ type Config struct {
 	TmpDir      string `toml:"tmp_dir"`
 	Profiler    bool   `toml:"profiler"`
 
+	// Image engine, by its registered name, and the number of supervised
+	// worker processes to run it in, 0 runs it in-process
+	Engine        string `toml:"engine"`
+	EngineWorkers int    `toml:"engine_workers"`
+
+	// Directory of the fonts text can be drawn with, and the file name of
+	// the one drawn without a txt_font. Text is refused without them.
+	FontDir     string `toml:"font_dir"`
+	FontDefault string `toml:"font_default"`
+
 	// [cluster]
 	Cluster struct {
 		LocalNode string   `toml:"local_node"`
@@ -50,10 +62,38 @@ type Config struct {
 		// Imgry limits
 		MaxFetchers    int `toml:"max_fetchers"`
 		MaxImageSizers int `toml:"max_image_sizers"`
+
+		// Max time a worker may spend on a single job before it's restarted
+		EngineWorkerTimeoutStr string `toml:"engine_worker_timeout"`
+		EngineWorkerTimeout    time.Duration
+
+		// Source image limits, checked before an image is decoded
+		MaxSourcePixels int `toml:"max_source_pixels"`
+		MaxSourceFrames int `toml:"max_source_frames"`
+		MaxSourceBytes  int `toml:"max_source_bytes"`
+
+		// ImageMagick resource limits, 0 keeps the ImageMagick default
+		MagickMemoryLimit int64 `toml:"magick_memory_limit"` // MB
+		MagickMapLimit    int64 `toml:"magick_map_limit"`    // MB
+		MagickDiskLimit   int64 `toml:"magick_disk_limit"`   // MB
+		MagickAreaLimit   int64 `toml:"magick_area_limit"`   // megapixels
+		MagickThreadLimit int64 `toml:"magick_thread_limit"`
+
+		// Sizing limits, requests outside of them are rejected with a 400
+		MaxOutputWidth  int      `toml:"max_output_width"`
+		MaxOutputHeight int      `toml:"max_output_height"`
+		AllowedOps      []string `toml:"allowed_ops"`
+		AllowedFormats  []string `toml:"allowed_formats"`
+		MinQuality      int      `toml:"min_quality"`
+		MaxQuality      int      `toml:"max_quality"`
+		MaxCanvasSize   int      `toml:"max_canvas_size"`
 	} `toml:"limits"`
 
 	HostExtraQueryParams map[string]url.Values `toml:"host_extra_query_params"`
 
+	// [buckets.<id>] settings of single buckets
+	Buckets map[string]BucketConfig `toml:"buckets"`
+
 	// [db]
 	DB struct {
 		RedisUri string `toml:"redis_uri"`
@@ -88,6 +128,23 @@ type Config struct {
 	} `toml:"ssl"`
 }
 
+// BucketConfig are the settings of a single bucket.
+type BucketConfig struct {
+	// Watermark params (wm, wm_pos, wm_scale, wm_alpha and wm_margin) put on
+	// every image of the bucket, replacing any the request asks for
+	Watermark string `toml:"watermark"`
+
+	// Formats format=auto may pick for the bucket, in order of preference.
+	// Empty leaves the choice of JPEG or PNG to the engine, AutoFormats
+	// are used when unset.
+	AutoFormats []string `toml:"auto_formats"`
+
+	// Background of the images of the bucket, when the request has no bg.
+	// Padding is filled with it and formats without alpha are flattened
+	// onto it.
+	Background string `toml:"background"`
+}
+
 var (
 	ErrNoConfigFile = errors.New("no configuration file specified")
 
@@ -102,6 +159,7 @@ func init() {
 		CacheMaxAge: 0,
 		TmpDir:      "",
 		Profiler:    false,
+		Engine:      "imagick",
 	}
 
 	// Available RAM / Avg RAM a single job requires. (e.g.: 4096 / 50 = 81)
@@ -122,6 +180,21 @@ func init() {
 	// Max parallel image operations
 	cf.Limits.MaxImageSizers = 20
 
+	// Max time of a single job of an engine worker
+	cf.Limits.EngineWorkerTimeout = 30 * time.Second
+
+	// Max source image dimensions (width*height), number of frames and size in bytes
+	cf.Limits.MaxSourcePixels = 100 * 1000 * 1000
+	cf.Limits.MaxSourceFrames = 500
+	cf.Limits.MaxSourceBytes = 50 * 1024 * 1024
+
+	// Max width and height of a sized image
+	cf.Limits.MaxOutputWidth = 5000
+	cf.Limits.MaxOutputHeight = 5000
+
+	// Max width and height of a canvas
+	cf.Limits.MaxCanvasSize = imgry.CanvasMaxSize
+
 	DefaultConfig = cf
 }
 
@@ -161,6 +234,9 @@ func (cf *Config) Apply() (err error) {
 	}
 
 	// limits
+	if cf.Limits.MaxCanvasSize > 0 {
+		imgry.CanvasMaxSize = cf.Limits.MaxCanvasSize
+	}
 	if cf.Limits.RequestTimeoutStr != "" {
 		to, err := time.ParseDuration(cf.Limits.RequestTimeoutStr)
 		if err != nil {
@@ -175,6 +251,50 @@ func (cf *Config) Apply() (err error) {
 		}
 		cf.Limits.BacklogTimeout = to
 	}
+	if cf.Limits.EngineWorkerTimeoutStr != "" {
+		to, err := time.ParseDuration(cf.Limits.EngineWorkerTimeoutStr)
+		if err != nil {
+			return err
+		}
+		cf.Limits.EngineWorkerTimeout = to
+	}
+
+	// fonts
+	if cf.FontDefault != "" {
+		if cf.FontDir == "" || filepath.Base(cf.FontDefault) != cf.FontDefault {
+			return fmt.Errorf("invalid font_default: %s", cf.FontDefault)
+		}
+		if _, err := os.Stat(filepath.Join(cf.FontDir, cf.FontDefault)); err != nil {
+			return fmt.Errorf("invalid font_default: %s", err)
+		}
+	}
+
+	// buckets
+	for id, bc := range cf.Buckets {
+		if bc.Background != "" {
+			if _, err := imgry.ParseColor(bc.Background); err != nil {
+				return fmt.Errorf("invalid background of bucket %s: %s", id, bc.Background)
+			}
+		}
+		for _, f := range bc.AutoFormats {
+			if _, ok := MimeTypes[f]; !ok {
+				return fmt.Errorf("invalid auto format of bucket %s: %s", id, f)
+			}
+		}
+		if bc.Watermark == "" {
+			continue
+		}
+		sz, err := imgry.NewSizingFromQuery(bc.Watermark)
+		if err == nil && sz.Watermark == nil {
+			err = errors.New("no wm param")
+		}
+		if err == nil {
+			err = sz.Validate(nil)
+		}
+		if err != nil {
+			return fmt.Errorf("invalid watermark of bucket %s: %s", id, err)
+		}
+	}
 
 	return nil
 }
@@ -190,6 +310,44 @@ func (cf *Config) GetDB() (*DB, error) {
 	return db, nil
 }
 
+// GetEngine returns the configured image engine, set up with the [limits]
+// that apply to it.
+func (cf *Config) GetEngine() (imgry.Engine, error) {
+	ng, err := imgry.NewEngine(cf.Engine)
+	if err != nil {
+		return nil, err
+	}
+
+	switch e := ng.(type) {
+	case imagick.Engine:
+		e.Limits = cf.GetImagickLimits()
+		e.Wands = imagick.NewWandPool(cf.Limits.MaxImageSizers)
+		ng = e
+	}
+	return ng, nil
+}
+
+func (cf *Config) GetImagickLimits() imagick.ResourceLimits {
+	return imagick.ResourceLimits{
+		Memory:  cf.Limits.MagickMemoryLimit * 1024 * 1024,
+		Map:     cf.Limits.MagickMapLimit * 1024 * 1024,
+		Disk:    cf.Limits.MagickDiskLimit * 1024 * 1024,
+		Area:    cf.Limits.MagickAreaLimit * 1000 * 1000,
+		Threads: cf.Limits.MagickThreadLimit,
+	}
+}
+
+func (cf *Config) GetSizingLimits() *imgry.SizingLimits {
+	return &imgry.SizingLimits{
+		MaxWidth:   cf.Limits.MaxOutputWidth,
+		MaxHeight:  cf.Limits.MaxOutputHeight,
+		Ops:        cf.Limits.AllowedOps,
+		Formats:    cf.Limits.AllowedFormats,
+		MinQuality: cf.Limits.MinQuality,
+		MaxQuality: cf.Limits.MaxQuality,
+	}
+}
+
 func (cf *Config) GetChainstore() (chainstore.Store, error) {
 	// chainstore.DefaultTimeout = 60 * time.Second // TODO: ....
 
@@ -4,7 +4,7 @@ import (
 	"context"
 	"crypto/tls"
 	"errors"
-	"io/ioutil"
+	"io"
 	"net"
 	"net/http"
 	"net/url"
@@ -99,6 +99,20 @@ func (f Fetcher) Get(ctx context.Context, url string) (*FetcherResponse, error)
 	return resp, nil
 }
 
+// Open fetches the url and returns its body without reading it, so the
+// caller can read it where it's needed. The caller must close the body.
+func (f Fetcher) Open(ctx context.Context, url string) (*FetcherResponse, io.ReadCloser, error) {
+	defer metrics.MeasureSince([]string{"fn.FetchRemoteStream"}, time.Now())
+
+	fetch := &FetcherResponse{}
+	resp, err := f.do(ctx, fetch, url)
+	if err != nil {
+		fetch.Err = err
+		return fetch, nil, err
+	}
+	return fetch, resp.Body, nil
+}
+
 func (f Fetcher) GetAll(ctx context.Context, urls []string) ([]*FetcherResponse, error) {
 	defer metrics.MeasureSince([]string{"fn.FetchRemoteData"}, time.Now())
 
@@ -114,45 +128,14 @@ func (f Fetcher) GetAll(ctx context.Context, urls []string) ([]*FetcherResponse,
 		go func(fetch *FetcherResponse, reqURL string) {
 			defer wg.Done()
 
-			u, err := urlx.Parse(reqURL)
-			if err != nil {
-				fetch.Err = err
-				return
-			}
-			uCopy := *u
-			fetch.URL = &uCopy
-
-			if params, ok := app.Config.HostExtraQueryParams[u.Host]; ok {
-				q := u.Query()
-				for key, vals := range params {
-					for _, v := range vals {
-						q.Add(key, v)
-					}
-				}
-				u.RawQuery = q.Encode()
-			}
-
-			lg.Infof("Fetching %s", uCopy.String())
-
-			req, err := http.NewRequest("GET", u.String(), nil)
+			resp, err := f.do(ctx, fetch, reqURL)
 			if err != nil {
 				fetch.Err = err
 				return
 			}
-			req.Header.Set("User-Agent", DefaultUserAgent)
-			req.Header.Set("Accept", "*/*")
-
-			resp, err := ctxhttp.Do(ctx, f.client(), req)
-			if err != nil {
-				lg.Warnf("Error fetching %s because %s", uCopy.String(), err)
-				fetch.Err = err
-				return
-			}
 			defer resp.Body.Close()
 
-			fetch.Status = resp.StatusCode
-
-			body, err := ioutil.ReadAll(resp.Body)
+			body, err := readSource(ctx, resp.Body)
 			if err != nil {
 				fetch.Err = err
 				return
@@ -166,3 +149,42 @@ func (f Fetcher) GetAll(ctx context.Context, urls []string) ([]*FetcherResponse,
 	wg.Wait()
 	return fetches, nil
 }
+
+// do requests the url and sets the URL and Status of the fetch. The
+// response body is left for the caller to read and close.
+func (f Fetcher) do(ctx context.Context, fetch *FetcherResponse, reqURL string) (*http.Response, error) {
+	u, err := urlx.Parse(reqURL)
+	if err != nil {
+		return nil, err
+	}
+	uCopy := *u
+	fetch.URL = &uCopy
+
+	if params, ok := app.Config.HostExtraQueryParams[u.Host]; ok {
+		q := u.Query()
+		for key, vals := range params {
+			for _, v := range vals {
+				q.Add(key, v)
+			}
+		}
+		u.RawQuery = q.Encode()
+	}
+
+	lg.Infof("Fetching %s", uCopy.String())
+
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", DefaultUserAgent)
+	req.Header.Set("Accept", "*/*")
+
+	resp, err := ctxhttp.Do(ctx, f.client(), req)
+	if err != nil {
+		lg.Warnf("Error fetching %s because %s", uCopy.String(), err)
+		return nil, err
+	}
+
+	fetch.Status = resp.StatusCode
+	return resp, nil
+}
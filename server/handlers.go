@@ -1,11 +1,17 @@
 package server
 
 import (
+	"context"
 	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/goware/lg"
@@ -13,6 +19,7 @@ import (
 	"github.com/pressly/chi"
 	"github.com/pressly/imgry"
 	"github.com/pressly/imgry/imagick"
+	"github.com/pressly/imgry/worker"
 )
 
 var (
@@ -24,11 +31,198 @@ var (
 		"bm":   "image/bmp",
 		"gif":  "image/gif",
 		"ico":  "image/x-icon",
+		"webp": "image/webp",
+		"avif": "image/avif",
+		"jxl":  "image/jxl",
 	}
 
-	ErrInvalidURL = errors.New("invalid url")
+	// AutoFormats are the formats format=auto picks from, in order of
+	// preference, unless the bucket has its own
+	AutoFormats = []string{"avif", "webp"}
+
+	ErrInvalidURL        = errors.New("invalid url")
+	ErrUnsupportedFormat = errors.New("output format is not supported by the image engine")
 )
 
+// errorStatus returns the response status for err, falling back to status
+// for errors that aren't otherwise known. A request that was canceled or
+// ran out of time while sizing is reported as such.
+func errorStatus(err error, status int) int {
+	switch err {
+	case ErrImageTooLarge:
+		return http.StatusRequestEntityTooLarge
+	case ErrUnsupportedFormat:
+		return http.StatusUnsupportedMediaType
+	case worker.ErrWorkerCrashed, worker.ErrWorkerTimeout:
+		return http.StatusBadGateway
+	case context.Canceled:
+		return http.StatusServiceUnavailable
+	case context.DeadlineExceeded:
+		return http.StatusGatewayTimeout
+	default:
+		return status
+	}
+}
+
+// sizingFromQuery returns the sizing of the query for bucket b, validated
+// against the configured limits. A watermark the bucket puts on all of its
+// images replaces the one of the query, and its background is the default
+// of the query's.
+func sizingFromQuery(b *Bucket, q string) (*imgry.Sizing, error) {
+	bc := b.Config()
+	if wm := bc.Watermark; wm != "" {
+		var err error
+		if q, err = enforceWatermark(q, wm); err != nil {
+			return nil, err
+		}
+	}
+
+	sizing, err := imgry.NewSizingFromQuery(q)
+	if err != nil {
+		return nil, err
+	}
+	if sizing.Background == nil && bc.Background != "" {
+		// Checked as the config was loaded
+		c, _ := imgry.ParseColor(bc.Background)
+		sizing.Background = &c
+	}
+	limits := app.Config.GetSizingLimits()
+	limits.NoText = !imgry.DrawsText(app.ImageEngine)
+	if err := sizing.Validate(limits); err != nil {
+		return nil, err
+	}
+	if f := sizing.Format; f != "" && f != imgry.FormatAuto && !engineEncodes(f) {
+		return nil, ErrUnsupportedFormat
+	}
+	if txt := sizing.Text; txt != nil {
+		if err := resolveFont(txt); err != nil {
+			return nil, err
+		}
+	}
+	return sizing, nil
+}
+
+// resolveFont sets the font file of the text, which must be one of the
+// configured font directory. Text without a font gets the default one, so
+// that it's never left to whatever font the engine falls back on.
+func resolveFont(txt *imgry.Text) error {
+	font := txt.Font
+	if font == "" {
+		font = app.Config.FontDefault
+		if app.Config.FontDir == "" || font == "" {
+			return &imgry.SizingError{Param: "txt", Value: txt.Text, Reason: "no default font is configured"}
+		}
+	}
+	if app.Config.FontDir == "" {
+		return &imgry.SizingError{Param: "txt_font", Value: font, Reason: "no fonts are configured"}
+	}
+	fn := filepath.Join(app.Config.FontDir, font)
+	if fi, err := os.Stat(fn); err != nil || !fi.Mode().IsRegular() {
+		return &imgry.SizingError{Param: "txt_font", Value: font, Reason: "unknown font"}
+	}
+	txt.FontFile = fn
+	return nil
+}
+
+// enforceWatermark returns the query with its watermark params replaced by
+// those of wm.
+func enforceWatermark(q, wm string) (string, error) {
+	query, err := url.ParseQuery(q)
+	if err != nil {
+		return "", err
+	}
+	for k := range query {
+		if k == "wm" || strings.HasPrefix(k, "wm_") {
+			delete(query, k)
+		}
+	}
+
+	params, err := url.ParseQuery(wm)
+	if err != nil {
+		return "", err
+	}
+	for k, v := range params {
+		query[k] = v
+	}
+	return query.Encode(), nil
+}
+
+// negotiateFormat picks the output format of format=auto, the first of the
+// auto formats of bucket b the client accepts, that's allowed and that the
+// engine encodes. Otherwise it stays auto, for the engine to pick JPEG or
+// PNG from the content of the image, which is recorded as its format.
+func negotiateFormat(b *Bucket, accept string) string {
+	formats := b.Config().AutoFormats
+	if formats == nil {
+		formats = AutoFormats
+	}
+	for _, f := range formats {
+		if accepts(accept, MimeTypes[f]) && formatAllowed(f) && engineEncodes(f) {
+			return f
+		}
+	}
+	return imgry.FormatAuto
+}
+
+// engineEncodes reports whether the image engine can output format.
+func engineEncodes(format string) bool {
+	format = strings.ToLower(format)
+	if format == "jpeg" {
+		format = "jpg"
+	}
+	for _, f := range app.ImageEngine.Formats() {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
+
+func formatAllowed(format string) bool {
+	allowed := app.Config.Limits.AllowedFormats
+	if len(allowed) == 0 {
+		return true
+	}
+	for _, f := range allowed {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
+
+// accepts reports whether the value of an Accept header lists the mime
+// type, without a q of 0. Wildcards don't count.
+func accepts(accept, mime string) bool {
+	for _, part := range strings.Split(accept, ",") {
+		params := strings.Split(part, ";")
+		if !strings.EqualFold(strings.TrimSpace(params[0]), mime) {
+			continue
+		}
+		for _, p := range params[1:] {
+			p = strings.TrimSpace(p)
+			if strings.HasPrefix(p, "q=") {
+				if q, err := strconv.ParseFloat(p[2:], 64); err == nil && q == 0 {
+					return false
+				}
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// respondSizingError responds with a 400 for an invalid sizing param, a
+// 415 for an output format the engine doesn't have, and with a 422 for a
+// query that couldn't be parsed at all.
+func respondSizingError(w http.ResponseWriter, err error) {
+	if serr, ok := err.(*imgry.SizingError); ok {
+		respond.SizingError(w, serr)
+		return
+	}
+	respond.ImageError(w, errorStatus(err, 422), err)
+}
+
 func BucketGetIndex(w http.ResponseWriter, r *http.Request) {
 	if r.URL.Query().Get("url") == "" {
 		respond.Data(w, 200, []byte{})
@@ -58,6 +252,12 @@ func BucketFetchItem(w http.ResponseWriter, r *http.Request) {
 	}
 	fetchUrl = u.String()
 
+	// Reject a bad sizing before fetching the image for it
+	if _, err := sizingFromQuery(bucket, r.URL.RawQuery); err != nil {
+		respondSizingError(w, err)
+		return
+	}
+
 	imKey := sha1Hash(fetchUrl) // transform to what is expected..
 
 	rctx := chi.RouteContext(ctx)
@@ -74,10 +274,10 @@ func BucketFetchItem(w http.ResponseWriter, r *http.Request) {
 	if err == ErrImageNotFound {
 		// TODO: add image sizing throttler here....
 
-		_, err := bucket.AddImagesFromUrls(ctx, []string{fetchUrl})
+		_, err := bucket.AddImageFromUrl(ctx, fetchUrl)
 		if err != nil {
 			lg.Errorf("Fetching failed for %s because %s", fetchUrl, err)
-			respond.ImageError(w, 422, err)
+			respond.ImageError(w, errorStatus(err, 422), err)
 			return
 		}
 	}
@@ -96,17 +296,24 @@ func BucketGetItem(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	sizing, err := imgry.NewSizingFromQuery(r.URL.RawQuery)
+	sizing, err := sizingFromQuery(bucket, r.URL.RawQuery)
 	if err != nil {
 		lg.Errorf("Failed to create sizing for %s cause: %s", r.URL, err)
-		respond.ImageError(w, 422, err)
+		respondSizingError(w, err)
 		return
 	}
 
+	// The format picked for format=auto is part of the query of the size,
+	// so each is stored and found under its own key
+	if sizing.Format == imgry.FormatAuto {
+		sizing.Format = negotiateFormat(bucket, r.Header.Get("Accept"))
+		w.Header().Set("Vary", "Accept")
+	}
+
 	im, err := bucket.GetImageSize(ctx, chi.URLParamFromCtx(ctx, "key"), sizing)
 	if err != nil {
 		lg.Errorf("Failed to get image for %s cause: %s", r.URL, err)
-		respond.ImageError(w, 422, err)
+		respond.ImageError(w, errorStatus(err, 422), err)
 		return
 	}
 
@@ -115,6 +322,10 @@ func BucketGetItem(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("X-Meta-Height", fmt.Sprintf("%d", im.Height))
 	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", app.Config.CacheMaxAge))
 	w.Header().Set("Last-Modified", time.Now().Format(http.TimeFormat))
+	if r.URL.Query().Get("dpr") != "" {
+		// The DPR may have been lowered to not upscale the source
+		w.Header().Set("Content-DPR", strconv.FormatFloat(sizing.DPR, 'f', -1, 64))
+	}
 
 	// If requested, only return the image details instead of the data
 	if r.URL.Query().Get("info") != "" {
@@ -124,7 +335,8 @@ func BucketGetItem(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	respond.Data(w, 200, im.Data)
+	w.WriteHeader(200)
+	im.WriteTo(w)
 }
 
 // TODO: this can be optimized significantly..........
@@ -139,13 +351,12 @@ func GetImageInfo(w http.ResponseWriter, r *http.Request) {
 
 	response, err := app.Fetcher.Get(ctx, url)
 	if err != nil {
-		respond.ApiError(w, 422, err)
+		respond.ApiError(w, errorStatus(err, 422), err)
 		return
 	}
 	data := response.Data
 
-	ng := imagick.Engine{}
-	imfo, err := ng.GetImageInfo(data)
+	imfo, err := app.ImageEngine.GetImageInfo(data)
 	if err != nil {
 		respond.ApiError(w, 422, err)
 		return
@@ -159,6 +370,21 @@ func GetImageInfo(w http.ResponseWriter, r *http.Request) {
 	respond.JSON(w, 200, imfo)
 }
 
+// Shows the engine version and, when the engine reports them, the
+// current usage of its resources.
+func GetEngineInfo(w http.ResponseWriter, r *http.Request) {
+	ng := app.ImageEngine
+	info := map[string]interface{}{"version": ng.Version(), "formats": ng.Formats()}
+
+	if rng, ok := ng.(interface {
+		Resources() map[string]imagick.Resource
+	}); ok {
+		info["resources"] = rng.Resources()
+	}
+
+	respond.JSON(w, 200, info)
+}
+
 // Image upload to an s3 bucket, respond with a direct url to the uploaded
 // image. Avoid using respond.ApiError() here to prevent any of the responses
 // from being cached.
@@ -170,17 +396,25 @@ func BucketImageUpload(w http.ResponseWriter, r *http.Request) {
 
 	ctx := r.Context()
 
+	// Bound the form to what a base64 encoded source of max_source_bytes
+	// takes, with room for the rest of the form.
+	if max := app.Config.Limits.MaxSourceBytes; max > 0 {
+		n := base64.StdEncoding.EncodedLen(max) + 1<<20
+		r.Body = http.MaxBytesReader(w, r.Body, int64(n))
+	}
+
 	file, header, err := r.FormFile("file")
 	switch err {
 	case nil:
 		defer file.Close()
 
-		data, err = ioutil.ReadAll(file)
-		if err != nil {
-			respond.JSON(w, 422, map[string]interface{}{"error": err.Error()})
+		im = NewImageFromSrcUrl(header.Filename)
+		defer im.Release()
+
+		if err = im.LoadImageReader(ctx, file); err != nil {
+			respond.JSON(w, errorStatus(err, 422), map[string]interface{}{"error": err.Error()})
 			return
 		}
-		im = NewImageFromSrcUrl(header.Filename)
 
 	case http.ErrMissingFile:
 		base64file := r.FormValue("base64file")
@@ -189,9 +423,9 @@ func BucketImageUpload(w http.ResponseWriter, r *http.Request) {
 			respond.JSON(w, 422, map[string]interface{}{"error": "invalid file upload"})
 			return
 		}
-		data, err = base64.StdEncoding.DecodeString(base64file)
+		data, err = readSource(ctx, base64.NewDecoder(base64.StdEncoding, strings.NewReader(base64file)))
 		if err != nil {
-			respond.JSON(w, 422, map[string]interface{}{"error": err.Error()})
+			respond.JSON(w, errorStatus(err, 422), map[string]interface{}{"error": err.Error()})
 			return
 		}
 
@@ -200,17 +434,20 @@ func BucketImageUpload(w http.ResponseWriter, r *http.Request) {
 			fileLen = 10000
 		}
 		im = NewImageFromSrcUrl(string(base64file[0:fileLen]))
+		defer im.Release()
 
-	default:
-		respond.JSON(w, 422, map[string]interface{}{"error": err.Error()})
-		return
-	}
-
-	defer im.Release()
+		im.Data = data
+		if err = im.LoadImage(ctx); err != nil {
+			respond.JSON(w, errorStatus(err, 422), map[string]interface{}{"error": err.Error()})
+			return
+		}
 
-	im.Data = data
-	if err = im.LoadImage(); err != nil {
-		respond.JSON(w, 422, map[string]interface{}{"error": err.Error()})
+	default:
+		// http.MaxBytesReader has no error value to compare to before Go 1.19
+		if err.Error() == "http: request body too large" {
+			err = ErrImageTooLarge
+		}
+		respond.JSON(w, errorStatus(err, 422), map[string]interface{}{"error": err.Error()})
 		return
 	}
 
@@ -260,9 +497,9 @@ func BucketAddItems(w http.ResponseWriter, r *http.Request) {
 		// TODO: refactor.. ApiError will cache invalid image errors,
 		// but for an array of urls, we shouldn't cache the entire response
 		if len(urls) == 1 {
-			respond.ApiError(w, 422, err)
+			respond.ApiError(w, errorStatus(err, 422), err)
 		} else {
-			respond.JSON(w, 422, map[string]interface{}{"error": err.Error()})
+			respond.JSON(w, errorStatus(err, 422), map[string]interface{}{"error": err.Error()})
 		}
 		return
 	}
@@ -270,6 +507,45 @@ func BucketAddItems(w http.ResponseWriter, r *http.Request) {
 	respond.JSON(w, 200, images)
 }
 
+// Stores the default focal point, crop box and alt text of an original
+// image, sent as a JSON object with the fp, cb and alt keys. Sizes that don't
+// ask for a focal point or crop box of their own get these.
+func BucketPutItemMeta(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	bucket, err := NewBucket(chi.URLParamFromCtx(ctx, "bucket"))
+	if err != nil {
+		respond.JSON(w, 422, map[string]interface{}{"error": err.Error()})
+		return
+	}
+
+	var meta ImageMeta
+	if err := json.NewDecoder(r.Body).Decode(&meta); err != nil {
+		respond.JSON(w, 422, map[string]interface{}{"error": err.Error()})
+		return
+	}
+	if err := meta.Validate(); err != nil {
+		if serr, ok := err.(*imgry.SizingError); ok {
+			respond.JSON(w, http.StatusBadRequest, serr)
+		} else {
+			respond.JSON(w, 422, map[string]interface{}{"error": err.Error()})
+		}
+		return
+	}
+
+	im, err := bucket.DbSaveImageMeta(ctx, chi.URLParamFromCtx(ctx, "key"), meta)
+	if err == ErrImageNotFound {
+		respond.JSON(w, 404, map[string]interface{}{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		respond.JSON(w, 422, map[string]interface{}{"error": err.Error()})
+		return
+	}
+
+	respond.JSON(w, 200, im)
+}
+
 func BucketDeleteItem(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pressly/imgry"
+	"github.com/pressly/imgry/imagex"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResolveFont(t *testing.T) {
+	dir, err := ioutil.TempDir("", "imgry-fonts")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	for _, fn := range []string{"Regular.ttf", "Bold.ttf"} {
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, fn), []byte("font"), 0644))
+	}
+
+	var tests = []struct {
+		fontDir, fontDefault string
+		font                 string
+		fontFile             string
+		errParam             string
+	}{
+		{"", "", "", "", "txt"},
+		{dir, "", "", "", "txt"},
+		{"", "", "Bold.ttf", "", "txt_font"},
+		{dir, "", "Bold.ttf", filepath.Join(dir, "Bold.ttf"), ""},
+		{dir, "Regular.ttf", "", filepath.Join(dir, "Regular.ttf"), ""},
+		{dir, "Regular.ttf", "Bold.ttf", filepath.Join(dir, "Bold.ttf"), ""},
+		{dir, "Regular.ttf", "Italic.ttf", "", "txt_font"},
+	}
+
+	for _, tt := range tests {
+		conf := DefaultConfig
+		conf.FontDir, conf.FontDefault = tt.fontDir, tt.fontDefault
+		app = &Server{Config: &conf}
+
+		txt := &imgry.Text{Text: "Hello", Font: tt.font}
+		err := resolveFont(txt)
+		if tt.errParam != "" {
+			if assert.IsType(t, &imgry.SizingError{}, err, "%+v", tt) {
+				assert.Equal(t, tt.errParam, err.(*imgry.SizingError).Param, "%+v", tt)
+			}
+			continue
+		}
+		assert.NoError(t, err, "%+v", tt)
+		assert.Equal(t, tt.fontFile, txt.FontFile, "%+v", tt)
+	}
+}
+
+func TestSizingFromQueryText(t *testing.T) {
+	conf := DefaultConfig
+	app = &Server{Config: &conf, ImageEngine: imagex.Engine{}}
+	b, err := NewBucket("test")
+	assert.NoError(t, err)
+
+	// The pure-Go engine can't draw text
+	_, err = sizingFromQuery(b, "size=100x&txt=Hello")
+	if assert.IsType(t, &imgry.SizingError{}, err) {
+		assert.Equal(t, "txt", err.(*imgry.SizingError).Param)
+	}
+
+	_, err = sizingFromQuery(b, "size=100x")
+	assert.NoError(t, err)
+}
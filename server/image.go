@@ -1,10 +1,13 @@
 package server
 
 import (
+	"context"
 	"crypto/sha1"
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
+	"net/url"
 	"strings"
 	"time"
 
@@ -12,30 +15,96 @@ import (
 	"github.com/goware/lg"
 	"github.com/pressly/imgry"
 	"github.com/pressly/imgry/imagick"
+	"github.com/pressly/imgry/worker"
 )
 
 var (
 	EmptyImageKey = sha1Hash("")
 
 	ErrInvalidImageKey = errors.New("invalid image key")
+	ErrImageTooLarge   = errors.New("image exceeds the source limits")
 )
 
 // TODO: we should probably keep the Sizing as a url.Values and store it in the Hash value separately..
 // then we can query for things... ie. find key, with whatever sizing props... etc..
 
 type Image struct {
-	Key         string        `json:"key" redis:"key"`
-	SrcUrl      string        `json:"src_url" redis:"src"`
-	Width       int           `json:"width" redis:"w"`
-	Height      int           `json:"height" redis:"h"`
-	Format      string        `json:"format" redis:"f"`
-	SizingQuery string        `json:"-" redis:"q"` // query from below, for saving
-	Sizing      *imgry.Sizing `json:"-" redis:"-"`
-	Data        []byte        `json:"-" redis:"-"`
+	Key            string        `json:"key" redis:"key"`
+	SrcUrl         string        `json:"src_url" redis:"src"`
+	Width          int           `json:"width" redis:"w"`
+	Height         int           `json:"height" redis:"h"`
+	Format         string        `json:"format" redis:"f"`
+	SizingQuery    string        `json:"-" redis:"q"`   // query from below, for saving
+	AutoFocalPoint string        `json:"-" redis:"afp"` // found for smart crops of the original
+	Sizing         *imgry.Sizing `json:"-" redis:"-"`
+	Data           []byte        `json:"-" redis:"-"`
+
+	ImageMeta
 
 	img imgry.Image
 }
 
+// ImageMeta is stored with an original image, the focal point and crop box
+// are the defaults of the sizes made from it.
+type ImageMeta struct {
+	FocalPoint string `json:"fp,omitempty" redis:"fp"`
+	CropBox    string `json:"cb,omitempty" redis:"cb"`
+	Alt        string `json:"alt,omitempty" redis:"alt"`
+}
+
+// Validate checks the focal point and crop box, and puts them in the form
+// they're used in queries.
+func (m *ImageMeta) Validate() error {
+	q := url.Values{}
+	if m.FocalPoint != "" {
+		q.Set("fp", m.FocalPoint)
+	}
+	if m.CropBox != "" {
+		q.Set("cb", m.CropBox)
+	}
+	if len(q) == 0 {
+		return nil
+	}
+
+	sz, err := imgry.NewSizingFromQuery(q.Encode())
+	if err != nil {
+		return err
+	}
+	if err := sz.Validate(nil); err != nil {
+		return err
+	}
+
+	if sz.FocalPoint != nil {
+		m.FocalPoint = sz.FocalPoint.ToString()
+	}
+	if !sz.CropBox.Equal(imgry.ZeroFloatingRect) {
+		m.CropBox = sz.CropBox.ToString()
+	}
+	return nil
+}
+
+// applyTo fills in the focal point and crop box the sizing leaves out. The
+// focal point only matters to crops centered on one, and gives way to any
+// gravity the sizing asks for, auto included.
+func (m *ImageMeta) applyTo(sizing *imgry.Sizing) {
+	if m.CropBox != "" && sizing.CropBox.Equal(imgry.ZeroFloatingRect) {
+		if cb, err := imgry.NewFloatingRectFromQuery(m.CropBox); err == nil {
+			sizing.CropBox = cb
+		}
+	}
+
+	switch sizing.Op {
+	case "cover", "balance", "smart":
+	default:
+		return
+	}
+	if m.FocalPoint != "" && sizing.FocalPoint == nil && sizing.Gravity == "" {
+		if fp, err := imgry.NewFloatPointFromQuery(m.FocalPoint); err == nil {
+			sizing.FocalPoint = fp
+		}
+	}
+}
+
 // Hrmm.. how will we generate a Uid if we just have a blob and no srcurl..?
 // perhaps we allow the uid to be like "something.jpg" if they want..?
 // unlikely to be collisions anyways...
@@ -50,16 +119,98 @@ func NewImageFromSrcUrl(srcUrl string) *Image {
 
 func sha1Hash(in string) string {
 	hasher := sha1.New()
-	fmt.Fprintf(hasher, in)
+	// The input is used as the format, which mangles escapes like %2F, but
+	// the keys already stored depend on it.
+	fmt.Fprintf(hasher, in, []interface{}{}...)
 	return hex.EncodeToString(hasher.Sum(nil))
 }
 
-// Make sure to call Release() if methods LoadImage(), SizeIt()
-// or MakeSize() are called.
+// sha1HashV2 hashes the input as is, for keys that have never been stored
+// with sha1Hash.
+func sha1HashV2(in string) string {
+	hasher := sha1.New()
+	io.WriteString(hasher, in)
+	return hex.EncodeToString(hasher.Sum(nil))
+}
 
-func (im *Image) LoadImage() (err error) {
+// Make sure to call Release() if methods LoadImage(), LoadImageReader(),
+// SizeIt() or MakeSize() are called.
+
+func (im *Image) LoadImage(ctx context.Context) (err error) {
 	defer metrics.MeasureSince([]string{"fn.image.LoadImage"}, time.Now())
 
+	ng := app.ImageEngine
+	return im.load(func(formatHint string) (imgry.Image, error) {
+		if err := checkSourceLimits(ng, im.Data, formatHint); err != nil {
+			return nil, err
+		}
+		return ng.LoadBlob(ctx, im.Data, formatHint)
+	})
+}
+
+// Loads the image by reading its source from r, the image Data
+// is set from the engine once loaded. No more than max_source_bytes
+// are read from r.
+func (im *Image) LoadImageReader(ctx context.Context, r io.Reader) (err error) {
+	defer metrics.MeasureSince([]string{"fn.image.LoadImageReader"}, time.Now())
+
+	ng := app.ImageEngine
+	return im.load(func(formatHint string) (imgry.Image, error) {
+		// The source has to be buffered for the limits to be checked
+		// before it's decoded.
+		b, err := readSource(ctx, r)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkSourceLimits(ng, b, formatHint); err != nil {
+			return nil, err
+		}
+		return ng.LoadBlob(ctx, b, formatHint)
+	})
+}
+
+// Reads a source image from r, giving up with ErrImageTooLarge once
+// more than max_source_bytes have been read.
+func readSource(ctx context.Context, r io.Reader) ([]byte, error) {
+	max := app.Config.Limits.MaxSourceBytes
+	if max > 0 {
+		r = io.LimitReader(r, int64(max)+1)
+	}
+	b, err := imgry.ReadAll(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+	if max > 0 && len(b) > max {
+		return nil, ErrImageTooLarge
+	}
+	return b, nil
+}
+
+// Checks the source image against the pixel and frame [limits] of the
+// config, using the cheap GetImageInfo of the engine so that an image
+// declaring huge dimensions is rejected before any full decode. The
+// bytes of a source are limited as it's read, see readSource.
+func checkSourceLimits(ng imgry.Engine, b []byte, formatHint string) error {
+	limits := app.Config.Limits
+
+	if limits.MaxSourcePixels <= 0 && limits.MaxSourceFrames <= 0 {
+		return nil
+	}
+
+	imfo, err := ng.GetImageInfo(b, formatHint)
+	if err != nil {
+		return err
+	}
+	if limits.MaxSourcePixels > 0 && imfo.Width*imfo.Height > limits.MaxSourcePixels {
+		return ErrImageTooLarge
+	}
+	if limits.MaxSourceFrames > 0 && imfo.Frames > limits.MaxSourceFrames {
+		return ErrImageTooLarge
+	}
+	return nil
+}
+
+func (im *Image) load(loadFn func(formatHint string) (imgry.Image, error)) (err error) {
 	// TODO: throttle the number of images we load at a given time..
 	// this should be configurable...
 
@@ -78,9 +229,10 @@ func (im *Image) LoadImage() (err error) {
 		formatHint = "ico"
 	}
 
-	ng := imagick.Engine{}
-	im.img, err = ng.LoadBlob(im.Data, formatHint)
+	im.img, err = loadFn(formatHint)
 	if err != nil {
+		// In-process there is no recovering from an engine failure, see
+		// engine_workers to contain it to a worker process instead.
 		if err == imagick.ErrEngineFailure {
 			lg.Fatalf("**** ENGINE FAILURE on %s", im.SrcUrl)
 		}
@@ -108,8 +260,9 @@ func (im *Image) IsValidImage() bool {
 	return im.Width > 0 && im.Height > 0 && im.Format != ""
 }
 
-// Sizes the current image in place
-func (im *Image) SizeIt(sizing *imgry.Sizing) error {
+// Sizes the current image in place. The sizing is aborted once ctx is done,
+// in which case the context error is returned as is.
+func (im *Image) SizeIt(ctx context.Context, sizing *imgry.Sizing) error {
 	defer metrics.MeasureSince([]string{"fn.image.SizeIt"}, time.Now())
 
 	if err := im.ValidateKey(); err != nil {
@@ -117,14 +270,13 @@ func (im *Image) SizeIt(sizing *imgry.Sizing) error {
 	}
 
 	if im.img == nil {
-		if err := im.LoadImage(); err != nil {
+		if err := im.LoadImage(ctx); err != nil {
 			return err
 		}
 	}
 
-	err := im.img.SizeIt(sizing)
-	if err != nil {
-		return fmt.Errorf("Error occurred when sizing an image: %s", err)
+	if err := im.img.SizeIt(ctx, sizing); err != nil {
+		return sizingError(err)
 	}
 
 	im.sync()
@@ -133,34 +285,63 @@ func (im *Image) SizeIt(sizing *imgry.Sizing) error {
 }
 
 // Create a new blob object from an existing size
-func (im *Image) MakeSize(sizing *imgry.Sizing) (*Image, error) {
+func (im *Image) MakeSize(ctx context.Context, sizing *imgry.Sizing) (*Image, error) {
 	defer metrics.MeasureSince([]string{"fn.image.MakeSize"}, time.Now())
 
-	if err := im.ValidateKey(); err != nil {
+	images, err := im.SizeMany(ctx, []*imgry.Sizing{sizing})
+	if err != nil {
 		return nil, err
 	}
+	return images[0], nil
+}
+
+// Create a new blob object for each of the sizings, decoding the
+// originating image only once. The image itself is left as is, and when
+// not loaded yet it's only loaded for the time of the sizing.
+func (im *Image) SizeMany(ctx context.Context, sizings []*imgry.Sizing) ([]*Image, error) {
+	defer metrics.MeasureSince([]string{"fn.image.SizeMany"}, time.Now())
 
-	im2 := &Image{
-		Key:         im.Key,
-		Data:        im.Data,
-		SrcUrl:      im.SrcUrl,
-		Sizing:      sizing,
-		SizingQuery: sizing.ToQuery().Encode(),
+	if err := im.ValidateKey(); err != nil {
+		return nil, err
 	}
 
-	// Clone the originating image
-	var err error
+	src := im
+	if im.img == nil {
+		src = &Image{Key: im.Key, Data: im.Data, SrcUrl: im.SrcUrl}
+		if err := src.LoadImage(ctx); err != nil {
+			return nil, err
+		}
+		defer src.Release()
+	}
 
-	if err = im2.LoadImage(); err != nil {
-		return nil, err
+	imgs, err := imgry.SizeMany(ctx, src.img, sizings)
+	if err != nil {
+		return nil, sizingError(err)
 	}
 
-	// Resize the new image object
-	if err = im2.SizeIt(sizing); err != nil {
-		return nil, err
+	images := make([]*Image, len(imgs))
+	for n, img := range imgs {
+		images[n] = &Image{
+			Key:         im.Key,
+			SrcUrl:      im.SrcUrl,
+			Sizing:      sizings[n],
+			SizingQuery: sizings[n].ToQuery().Encode(),
+			img:         img,
+		}
+		images[n].sync()
 	}
 
-	return im2, nil
+	return images, nil
+}
+
+// Context and worker errors are passed as is, so that the handlers can
+// tell them apart.
+func sizingError(err error) error {
+	switch err {
+	case context.Canceled, context.DeadlineExceeded, worker.ErrWorkerCrashed, worker.ErrWorkerTimeout:
+		return err
+	}
+	return fmt.Errorf("Error occurred when sizing an image: %s", err)
 }
 
 func (im *Image) ValidateKey() error {
@@ -178,6 +359,12 @@ func (im *Image) MimeType() string {
 	return mt
 }
 
+// Writes the image data to w.
+func (im *Image) WriteTo(w io.Writer) (int64, error) {
+	n, err := w.Write(im.Data)
+	return int64(n), err
+}
+
 func (im *Image) Release() {
 	if im == nil {
 		return
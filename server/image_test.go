@@ -0,0 +1,167 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"testing"
+
+	"github.com/pressly/imgry"
+	"github.com/pressly/imgry/imagex"
+	"github.com/pressly/imgry/worker"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMain(m *testing.M) {
+	if os.Getenv("IMGRY_TEST_WORKER") != "" {
+		jobs, results := worker.Files()
+		if err := worker.Serve(crashEngine{}, jobs, results); err != nil {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// crashEngine is the imagex engine, except its images crash the worker
+// when they're sized
+type crashEngine struct {
+	imagex.Engine
+}
+
+func (ng crashEngine) LoadBlob(ctx context.Context, b []byte, srcFormat ...string) (imgry.Image, error) {
+	img, err := ng.Engine.LoadBlob(ctx, b, srcFormat...)
+	if err != nil {
+		return nil, err
+	}
+	return crashImage{img}, nil
+}
+
+type crashImage struct {
+	imgry.Image
+}
+
+func (i crashImage) SizeIt(ctx context.Context, sz *imgry.Sizing) error {
+	os.Exit(2)
+	return nil
+}
+
+func TestSizingWorkerCrash(t *testing.T) {
+	ng := worker.New(1, 0, func() *exec.Cmd {
+		cmd := exec.Command(os.Args[0])
+		cmd.Env = append(os.Environ(), "IMGRY_TEST_WORKER=1")
+		return cmd
+	})
+	assert.NoError(t, ng.Initialize(""))
+	defer ng.Terminate()
+
+	conf := DefaultConfig
+	app = &Server{Config: &conf, ImageEngine: ng}
+	respond = NewResponder()
+
+	data, err := ioutil.ReadFile("../testdata/gophers.jpg")
+	assert.NoError(t, err)
+	im := &Image{Key: sha1Hash("gophers"), Data: data}
+
+	sz, _ := imgry.NewSizingFromQuery("size=100x")
+	_, err = im.MakeSize(context.Background(), sz)
+	assert.Equal(t, worker.ErrWorkerCrashed, err)
+
+	// Responded as BucketGetItem does
+	w := httptest.NewRecorder()
+	respond.ImageError(w, errorStatus(err, 422), err)
+	assert.Equal(t, http.StatusBadGateway, w.Code)
+}
+
+func TestSourceBytesLimit(t *testing.T) {
+	conf := DefaultConfig
+	conf.Limits.MaxSourceBytes = 1000
+	app = &Server{Config: &conf, ImageEngine: imagex.Engine{}}
+	respond = NewResponder()
+
+	data, err := ioutil.ReadFile("../testdata/gophers.jpg")
+	assert.NoError(t, err)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(data)
+	}))
+	defer ts.Close()
+
+	fetches, err := NewFetcher().GetAll(context.Background(), []string{ts.URL})
+	assert.NoError(t, err)
+	assert.Equal(t, ErrImageTooLarge, fetches[0].Err)
+	assert.Empty(t, fetches[0].Data)
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fw, err := mw.CreateFormFile("file", "gophers.jpg")
+	assert.NoError(t, err)
+	fw.Write(data)
+	mw.Close()
+
+	r := httptest.NewRequest("POST", "/upload", &body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	w := httptest.NewRecorder()
+	BucketImageUpload(w, r)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+
+	// So is a base64 encoded one
+	body.Reset()
+	mw = multipart.NewWriter(&body)
+	mw.WriteField("base64file", base64.StdEncoding.EncodeToString(data))
+	mw.Close()
+
+	r = httptest.NewRequest("POST", "/upload", &body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	w = httptest.NewRecorder()
+	BucketImageUpload(w, r)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+}
+
+func TestImageMetaApplyTo(t *testing.T) {
+	meta := &ImageMeta{FocalPoint: "0.2,0.3", CropBox: "0,0,0.5,0.5"}
+
+	var tests = []struct {
+		query string
+		fp    string
+		cb    string
+	}{
+		{"size=100x100&op=smart", "0.20,0.30", "0.00,0.00,0.50,0.50"},
+		{"size=100x100&op=cover", "0.20,0.30", "0.00,0.00,0.50,0.50"},
+		{"size=100x100", "", "0.00,0.00,0.50,0.50"},
+		{"size=100x100&op=smart&fp=auto", "", "0.00,0.00,0.50,0.50"},
+		{"size=100x100&op=cover&gravity=auto", "", "0.00,0.00,0.50,0.50"},
+		{"size=100x100&op=cover&gravity=n", "", "0.00,0.00,0.50,0.50"},
+		{"size=100x100&op=smart&fp=0.5,0.5&cb=0.5,0.5,1,1", "0.50,0.50", "0.50,0.50,1,1"},
+	}
+
+	for _, tt := range tests {
+		sz, err := imgry.NewSizingFromQuery(tt.query)
+		assert.NoError(t, err)
+		meta.applyTo(sz)
+
+		fp := ""
+		if sz.FocalPoint != nil {
+			fp = sz.FocalPoint.ToString()
+		}
+		assert.Equal(t, tt.fp, fp, tt.query)
+		assert.Equal(t, tt.cb, sz.CropBox.ToString(), tt.query)
+	}
+}
+
+func TestSha1Hash(t *testing.T) {
+	// Pinned, the keys already stored depend on sha1Hash. The input is
+	// used as a format, so escapes only differing in their width collide.
+	assert.Equal(t, "da39a3ee5e6b4b0d3255bfef95601890afd80709", sha1Hash(""))
+	assert.Equal(t, sha1HashV2("txt=a%!C(MISSING)b"), sha1Hash("txt=a%2Cb"))
+	assert.Equal(t, sha1Hash("txt=a%2Cb"), sha1Hash("txt=a%3Cb"))
+
+	assert.NotEqual(t, sha1HashV2("txt=a%2Cb"), sha1HashV2("txt=a%3Cb"))
+	assert.Equal(t, sha1Hash("s=100x"), sha1HashV2("s=100x"))
+}
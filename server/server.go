@@ -2,6 +2,8 @@ package server
 
 import (
 	"net/http"
+	"os"
+	"os/exec"
 
 	"github.com/goware/cors"
 	"github.com/goware/heartbeat"
@@ -12,6 +14,10 @@ import (
 	"github.com/pressly/consistentrd"
 	"github.com/pressly/imgry"
 	"github.com/pressly/imgry/imagick"
+	"github.com/pressly/imgry/worker"
+
+	// Available engines
+	_ "github.com/pressly/imgry/imagex"
 )
 
 var (
@@ -54,7 +60,14 @@ func (srv *Server) Configure() (err error) {
 	srv.Fetcher = NewFetcher()
 
 	tmpDir := srv.Config.TmpDir
-	srv.ImageEngine = imagick.Engine{}
+	if n := srv.Config.EngineWorkers; n > 0 {
+		srv.ImageEngine = worker.New(n, srv.Config.Limits.EngineWorkerTimeout, workerCommand)
+	} else {
+		srv.ImageEngine, err = srv.Config.GetEngine()
+		if err != nil {
+			return err
+		}
+	}
 	if err := srv.ImageEngine.Initialize(tmpDir); err != nil {
 		return err
 	}
@@ -62,6 +75,32 @@ func (srv *Server) Configure() (err error) {
 	return nil
 }
 
+// Engine workers are the server binary itself, started with the same
+// arguments plus -worker.
+func workerCommand() *exec.Cmd {
+	exe, err := os.Executable()
+	if err != nil {
+		exe = os.Args[0]
+	}
+	return exec.Command(exe, append(os.Args[1:], "-worker")...)
+}
+
+// RunWorker serves the jobs of the parent server on the pipes it was
+// started with, until the parent closes them. A failure of the engine
+// ends the worker, which the parent then restarts.
+func RunWorker(conf *Config) error {
+	if err := conf.Apply(); err != nil {
+		return err
+	}
+
+	ng, err := conf.GetEngine()
+	if err != nil {
+		return err
+	}
+	jobs, results := worker.Files()
+	return worker.Serve(ng, jobs, results, imagick.ErrEngineFailure)
+}
+
 // Close signals to the server that should deny new requests
 // and finish up requests in progress.
 func (srv *Server) Close() {
@@ -106,6 +145,7 @@ func (srv *Server) NewRouter() http.Handler {
 	}
 
 	if srv.Config.Profiler {
+		r.Get("/debug/engine", GetEngineInfo)
 		r.Mount("/debug", middleware.Profiler())
 	}
 
@@ -143,6 +183,7 @@ func (srv *Server) NewRouter() http.Handler {
 		// r.With(conrd.Route()).Delete("/:key", BucketDeleteItem)
 		r.Get("/:key", BucketGetItem)
 		r.Delete("/:key", BucketDeleteItem)
+		r.Put("/:key/meta", BucketPutItemMeta)
 	})
 
 	return r
@@ -66,9 +66,17 @@ func (r *Responder) ApiError(w http.ResponseWriter, status int, err error) {
 	r.JSON(w, status, map[string]interface{}{"error": err.Error()})
 }
 
+// SizingError responds with the invalid sizing param as a 400.
+func (r *Responder) SizingError(w http.ResponseWriter, err *imgry.SizingError) {
+	r.cacheErrors(w, err)
+	r.JSON(w, http.StatusBadRequest, err)
+}
+
 func (r *Responder) cacheErrors(w http.ResponseWriter, err error) {
-	switch err {
-	case imgry.ErrInvalidImageData, ErrInvalidURL:
+	_, invalidSizing := err.(*imgry.SizingError)
+
+	switch {
+	case invalidSizing, err == imgry.ErrInvalidImageData, err == ErrInvalidURL, err == ErrImageTooLarge:
 		// For invalid inputs, we tell the surrogate to cache the
 		// error for a small amount of time.
 		w.Header().Set("Cache-Control", "s-maxage=300") // 5 minutes
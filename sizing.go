@@ -4,20 +4,48 @@ import (
 	"errors"
 	"fmt"
 	"image"
+	"image/color"
 	"math"
 	"net/url"
 	"strconv"
 	"strings"
 )
 
+// FormatAuto asks for the best output format the client accepts. The
+// server picks one of the formats it negotiates, or else leaves it to the
+// engine which picks one of AutoFormat.
+const FormatAuto = "auto"
+
+// MaxPaletteColors is the most colors of an image FormatAuto keeps as a
+// palette PNG.
+const MaxPaletteColors = 256
+
+// AutoFormat is the format of FormatAuto for a still image, PNG when it
+// has transparent pixels or few enough colors for a palette, JPEG for
+// photographic content.
+func AutoFormat(alpha bool, colors int) string {
+	if alpha || colors <= MaxPaletteColors {
+		return "png"
+	}
+	return "jpg"
+}
+
 var (
 	ZeroSizing = &Sizing{}
 
 	DefaultSizingGranularity = 10
+
+	// Max width and height of a canvas asked for by a query
+	CanvasMaxSize = 1024
 )
 
 const (
-	canvasMaxSize int = 1024
+	// Highest device pixel ratio a sizing may ask for
+	maxDPR float64 = 3
+
+	// Highest blur and sharpen sigmas, the cost grows with them
+	maxBlur    float64 = 50
+	maxSharpen float64 = 10
 )
 
 type Sizing struct {
@@ -25,12 +53,45 @@ type Sizing struct {
 	CropBox    *FloatingRect // The asking image crop box (as percentages)
 	FocalPoint *FloatPoint   // The asking image focal point (as percentages)
 	Canvas     *Rect
+	DPR        float64 // The device pixel ratio the size and canvas are multiplied by
+
+	Background *color.NRGBA // The fill of a padded image and of the alpha of formats without one, nil for the default
+	Gravity    string       // Where a padded image is placed, or a crop anchored
+
+	// Frames are turned and mirrored before anything else is done to them,
+	// so the crop box, focal point and size apply to the result
+	Rotate float64 // Degrees turned clockwise, from 0 to 360
+	Flip   string  // Mirrored horizontally (h), vertically (v) or both (hv)
+
+	// Resampling filter of the resize, one of ResampleFilters, the engine
+	// picks one by default. The unsharp mask is applied after the resize.
+	Filter  string
+	Unsharp *UnsharpMask
+
+	// Adjustments of every frame once it's sized, applied in this order
+	Grayscale  bool
+	Brightness int     // From -100 to 100
+	Contrast   int     // From -100 to 100
+	Saturation int     // From -100 to 100, -100 being gray
+	Gamma      float64 // From 0.1 to 10, 0 leaves it as is
+	Blur       float64 // Sigma of a gaussian blur
+	Sharpen    float64 // Sigma of the sharpening
+
+	// Caption drawn onto every frame once it's done, and the overlay
+	// composited over it
+	Text      *Text
+	Watermark *Watermark
 
 	Op          string
-	Format      string
+	Format      string // Output format, FormatAuto is left for the server to pick
 	Quality     int
 	Granularity int
 	Flatten     bool
+	Lossless    bool // Lossless compression, for the formats that have it
+
+	// Leave the pixels as they are stored, instead of turning them the way
+	// the EXIF orientation says they're displayed
+	KeepOrientation bool
 }
 
 func NewSizing() *Sizing {
@@ -39,6 +100,7 @@ func NewSizing() *Sizing {
 	sz.CropBox = &FloatingRect{&FloatPoint{}, &FloatPoint{}}
 	sz.Granularity = DefaultSizingGranularity
 	sz.Quality = 75
+	sz.DPR = 1
 	sz.Flatten = false
 	return sz
 }
@@ -81,8 +143,12 @@ func (sz *Sizing) CalcResizeRect(srcSize *Rect) (resizedRect *Rect, cropRect *Re
 		resizedRect, cropRect, cropOrigin = sz.coverOp(srcSize)
 	case "balance":
 		resizedRect, cropRect, cropOrigin = sz.balanceOp(srcSize)
+	case "smart":
+		resizedRect, cropRect, cropOrigin = sz.cropByOffset(srcSize, NewFloatPoint(0.5, 0.5))
 	case "fitted":
 		resizedRect, cropRect, cropOrigin = sz.fitted(srcSize)
+	case "pad":
+		resizedRect, cropRect, cropOrigin = sz.contain2Op(srcSize)
 	default:
 		resizedRect, cropRect, cropOrigin = sz.exactOp(srcSize)
 	}
@@ -118,8 +184,8 @@ func (sz *Sizing) contain2Op(srcSize *Rect) (*Rect, *Rect, *image.Point) {
 
 func (sz *Sizing) fitted(srcSize *Rect) (*Rect, *Rect, *image.Point) {
 	size := sz.calcScaledSize(srcSize, false)
-	if sz.Canvas != nil {
-		ratio := math.Min(float64(sz.Canvas.Width)/float64(size.Width), float64(sz.Canvas.Height)/float64(size.Height))
+	if canvas := sz.ScaledCanvas(); canvas != nil {
+		ratio := math.Min(float64(canvas.Width)/float64(size.Width), float64(canvas.Height)/float64(size.Height))
 		if ratio < 1 {
 			// This means the canvas is smaller than the source image.
 			size.Width = int(float64(size.Width) * ratio)
@@ -138,55 +204,86 @@ func (sz *Sizing) expandOp(srcSize *Rect) (*Rect, *Rect, *image.Point) {
 }
 
 func (sz *Sizing) coverOp(srcSize *Rect) (*Rect, *Rect, *image.Point) {
-	if sz.FocalPoint == nil {
-		sz.FocalPoint = NewFloatPoint(0.5, 0.5)
-	}
-	return sz.cropByOffset(srcSize)
+	return sz.cropByOffset(srcSize, NewFloatPoint(0.5, 0.5))
 }
 
 func (sz *Sizing) balanceOp(srcSize *Rect) (*Rect, *Rect, *image.Point) {
-	if sz.FocalPoint == nil {
-		sz.FocalPoint = NewFloatPoint(0.5, 0.33)
-	}
-	return sz.cropByOffset(srcSize)
+	return sz.cropByOffset(srcSize, NewFloatPoint(0.5, 0.33))
 }
 
-func (sz *Sizing) cropByOffset(srcSize *Rect) (*Rect, *Rect, *image.Point) {
+// cropByOffset crops around the anchor of the sizing, or around def when
+// it has none.
+func (sz *Sizing) cropByOffset(srcSize *Rect, def *FloatPoint) (*Rect, *Rect, *image.Point) {
+	anchor := sz.anchor(def)
 	rr := sz.calcScaledSize(srcSize, false)
 	if rr.AspectRatio() < srcSize.AspectRatio() {
-		return sz.cropByHeight(srcSize)
+		return sz.cropByHeight(srcSize, anchor)
 	}
-	return sz.cropByWidth(srcSize)
+	return sz.cropByWidth(srcSize, anchor)
 }
 
-func (sz *Sizing) cropByWidth(srcSize *Rect) (*Rect, *Rect, *image.Point) {
-	if sz.FocalPoint == nil {
-		sz.FocalPoint = NewFloatPoint(0.5, 0.5)
-	}
+func (sz *Sizing) cropByWidth(srcSize *Rect, anchor *FloatPoint) (*Rect, *Rect, *image.Point) {
 
 	rr := sz.scaleToWidth(srcSize)
-	diffY := float64(rr.Height)*sz.FocalPoint.Y - float64(sz.Size.Height)*0.5
+	size := sz.scale(sz.Size)
+	diffY := float64(rr.Height)*anchor.Y - float64(size.Height)*0.5
 	if diffY < 0 {
 		diffY = 0
 	}
 	// y can possibly be negative or larger than the image
-	y := min(round(diffY), rr.Height-sz.Size.Height)
-	return rr, sz.Size, &image.Point{0, y} // TODO: hmm.. returning sz.Size here...??
+	y := min(round(diffY), rr.Height-size.Height)
+	return rr, size, &image.Point{0, y} // TODO: hmm.. returning sz.Size here...??
 }
 
-func (sz *Sizing) cropByHeight(srcSize *Rect) (*Rect, *Rect, *image.Point) {
-	if sz.FocalPoint == nil {
-		sz.FocalPoint = NewFloatPoint(0.5, 0.5)
-	}
+func (sz *Sizing) cropByHeight(srcSize *Rect, anchor *FloatPoint) (*Rect, *Rect, *image.Point) {
 
 	rr := sz.scaleToHeight(srcSize)
-	diffX := float64(rr.Width)*sz.FocalPoint.X - float64(sz.Size.Width)*0.5
+	size := sz.scale(sz.Size)
+	diffX := float64(rr.Width)*anchor.X - float64(size.Width)*0.5
 	if diffX < 0 {
 		diffX = 0
 	}
 	// x can possibly be negative or larger than the image
-	x := min(round(diffX), rr.Width-sz.Size.Width)
-	return rr, sz.Size, &image.Point{x, 0} // TODO: hmm.. returning sz.Size ..?
+	x := min(round(diffX), rr.Width-size.Width)
+	return rr, size, &image.Point{x, 0} // TODO: hmm.. returning sz.Size ..?
+}
+
+// Returns the point a crop is centered on, def without a gravity or focal
+// point. An anchoring gravity takes precedence over the focal point, which
+// is set by the engine for the auto gravity.
+func (sz *Sizing) anchor(def *FloatPoint) *FloatPoint {
+	if p, ok := gravityAnchors[sz.Gravity]; ok {
+		return p
+	}
+	if sz.FocalPoint != nil {
+		return sz.FocalPoint
+	}
+	return def
+}
+
+// ReframesSource reports whether the frames are turned, mirrored or cropped
+// before they're sized, so that a focal point found on them isn't the one
+// of the source image.
+func (sz *Sizing) ReframesSource() bool {
+	return sz.Rotate != 0 || sz.Flip != "" ||
+		(sz.CropBox != nil && !sz.CropBox.Equal(ZeroFloatingRect))
+}
+
+// NeedsFocalPoint reports whether the engine has to find the focal point
+// of the image, with AutoFocalPoint, before sizing it. That's the case for
+// the smart op, unless anchored, and for crops with the auto gravity.
+func (sz *Sizing) NeedsFocalPoint() bool {
+	if sz.FocalPoint != nil {
+		return false
+	}
+	switch sz.Op {
+	case "smart":
+		return sz.Gravity == "" || sz.Gravity == "auto"
+	case "cover", "balance":
+		return sz.Gravity == "auto"
+	default:
+		return false
+	}
 }
 
 func (sz *Sizing) calcScaledSize(srcSize *Rect, scaleOrNot bool) *Rect {
@@ -203,13 +300,13 @@ func (sz *Sizing) calcScaledSize(srcSize *Rect, scaleOrNot bool) *Rect {
 		}
 		return sz.scaleToWidth(srcSize)
 	}
-	return sz.GranularizedSize()
+	return sz.ScaledSize()
 }
 
 // Returns a granularized width and a height scaled to the same ratio as original size
 func (sz *Sizing) scaleToWidth(srcSize *Rect) *Rect {
 	r := &Rect{}
-	r.Width = sz.GranularizedWidth()
+	r.Width = sz.ScaledSize().Width
 	r.Height = round(float64(r.Width) / srcSize.AspectRatio())
 	return r
 }
@@ -217,7 +314,7 @@ func (sz *Sizing) scaleToWidth(srcSize *Rect) *Rect {
 // Returns a granularized height and a width scaled to the same ratio as original size
 func (sz *Sizing) scaleToHeight(srcSize *Rect) *Rect {
 	r := &Rect{}
-	r.Height = sz.GranularizedHeight()
+	r.Height = sz.ScaledSize().Height
 	r.Width = round(float64(r.Height) * srcSize.AspectRatio())
 	return r
 }
@@ -236,6 +333,195 @@ func (sz *Sizing) GranularizedSize() *Rect {
 	return NewRect(sz.GranularizedWidth(), sz.GranularizedHeight())
 }
 
+// Returns the asked size in pixels, which is the size multiplied by the
+// DPR and then granularized
+func (sz *Sizing) ScaledSize() *Rect {
+	size := sz.scale(sz.Size)
+	return NewRect(sz.granularize(size.Width), sz.granularize(size.Height))
+}
+
+// Returns the canvas in pixels, or nil without a canvas
+func (sz *Sizing) ScaledCanvas() *Rect {
+	if sz.Canvas == nil {
+		return nil
+	}
+	return sz.scale(sz.Canvas)
+}
+
+func (sz *Sizing) scale(r *Rect) *Rect {
+	if sz.DPR <= 0 || sz.DPR == 1 {
+		return r
+	}
+	return NewRect(round(float64(r.Width)*sz.DPR), round(float64(r.Height)*sz.DPR))
+}
+
+// CalcCanvas returns the canvas an image of size is placed on, and where
+// it goes on it, or a nil canvas if it isn't put on one. Padded images get
+// a canvas of the asked size.
+func (sz *Sizing) CalcCanvas(size *Rect) (canvas *Rect, origin *image.Point) {
+	switch {
+	case sz.Op == "pad":
+		canvas = sz.ScaledSize()
+		if sz.Size.Width == 0 {
+			canvas.Width = size.Width
+		}
+		if sz.Size.Height == 0 {
+			canvas.Height = size.Height
+		}
+	case sz.Canvas != nil:
+		canvas = sz.ScaledCanvas()
+	default:
+		return nil, nil
+	}
+
+	origin = gravityOrigin(sz.Gravity, canvas.Width-size.Width, canvas.Height-size.Height, 0)
+	return canvas, origin
+}
+
+// CalcWatermark returns the size the watermark overlay, of wmSize, is
+// scaled to on an image of size, and where it goes on it.
+func (sz *Sizing) CalcWatermark(size, wmSize *Rect) (scaled *Rect, origin *image.Point) {
+	wm := sz.Watermark
+	scaled = NewRect(wmSize.Width, wmSize.Height)
+	if wm.Scale > 0 && wmSize.Width > 0 {
+		scaled.Width = round(float64(size.Width) * wm.Scale)
+		scaled.Height = round(float64(wmSize.Height) * float64(scaled.Width) / float64(wmSize.Width))
+		if scaled.Width < 1 {
+			scaled.Width = 1
+		}
+		if scaled.Height < 1 {
+			scaled.Height = 1
+		}
+	}
+
+	margin := sz.scale(NewRect(wm.Margin, 0)).Width
+	origin = gravityOrigin(wm.Gravity, size.Width-scaled.Width, size.Height-scaled.Height, margin)
+	return scaled, origin
+}
+
+// ScaledTextSize returns the point size of the text multiplied by the DPR.
+func (sz *Sizing) ScaledTextSize() float64 {
+	if sz.DPR <= 0 {
+		return sz.Text.Size
+	}
+	return sz.Text.Size * sz.DPR
+}
+
+// gravityOrigin returns where something goes at gravity, in a space dx and
+// dy larger than it, kept margin away from the edges it's put against.
+func gravityOrigin(gravity string, dx, dy, margin int) *image.Point {
+	origin := &image.Point{dx / 2, dy / 2}
+	switch gravity {
+	case "n", "ne", "nw":
+		origin.Y = margin
+	case "s", "se", "sw":
+		origin.Y = dy - margin
+	}
+	switch gravity {
+	case "w", "nw", "sw":
+		origin.X = margin
+	case "e", "ne", "se":
+		origin.X = dx - margin
+	}
+	return origin
+}
+
+// FillColor returns the color padding is filled with in an image of
+// format, and what's transparent is flattened onto when format has no
+// alpha channel. Without a background it's transparent, or white for
+// formats without an alpha channel, which get an opaque one either way.
+func (sz *Sizing) FillColor(format string) color.NRGBA {
+	switch {
+	case sz.Background != nil && FormatHasAlpha(format):
+		return *sz.Background
+	case sz.Background != nil:
+		c := *sz.Background
+		c.A = 0xff
+		return c
+	case FormatHasAlpha(format):
+		return Transparent
+	default:
+		return White
+	}
+}
+
+// CanvasFill returns the color a canvas is filled with in an image of
+// format. Canvases are transparent, unless padding or when format can't
+// be.
+func (sz *Sizing) CanvasFill(format string) color.NRGBA {
+	if sz.Op == "pad" || !FormatHasAlpha(format) {
+		return sz.FillColor(format)
+	}
+	return Transparent
+}
+
+// RotatedSize returns the size of an image of srcSize once turned, which
+// is the bounding box of the turned image for angles other than right ones.
+func (sz *Sizing) RotatedSize(srcSize *Rect) *Rect {
+	switch sz.Rotate {
+	case 0, 180:
+		return srcSize
+	case 90, 270:
+		return NewRect(srcSize.Height, srcSize.Width)
+	}
+	sin, cos := math.Sincos(sz.Rotate * math.Pi / 180)
+	w, h := float64(srcSize.Width), float64(srcSize.Height)
+	return NewRect(round(math.Abs(w*cos)+math.Abs(h*sin)), round(math.Abs(w*sin)+math.Abs(h*cos)))
+}
+
+// Transforms reports whether the sizing changes the pixels of an image at
+// all, other than by its format or quality.
+func (sz *Sizing) Transforms() bool {
+	return !sz.Size.Equal(ZeroRect) || !sz.CropBox.Equal(ZeroFloatingRect) ||
+		sz.Rotate != 0 || sz.Flip != "" || sz.Unsharp != nil || sz.Adjusts() ||
+		sz.Text != nil || sz.Watermark != nil
+}
+
+// Adjusts reports whether the sizing has any adjustment filter.
+func (sz *Sizing) Adjusts() bool {
+	return sz.Grayscale || sz.Brightness != 0 || sz.Contrast != 0 || sz.Saturation != 0 ||
+		sz.Gamma != 0 || sz.Blur != 0 || sz.Sharpen != 0
+}
+
+// ResolveDPR lowers the DPR so the scaled size doesn't go past an image of
+// srcSize, once turned and cropped by the crop box. The DPR is part of the
+// query, so it's resolved before the sizing is looked up or sized, and
+// resolving it again leaves it as is.
+func (sz *Sizing) ResolveDPR(srcSize *Rect) {
+	src := sz.RotatedSize(srcSize)
+	if sz.CropBox != nil && !sz.CropBox.Equal(ZeroFloatingRect) {
+		if cb, _, err := sz.CalcCropBox(src); err == nil && !cb.Equal(ZeroRect) {
+			src = cb
+		}
+	}
+	sz.DPR = sz.effectiveDPR(src)
+}
+
+// Returns the DPR lowered so the scaled size doesn't go past the source,
+// the asked size itself may still upscale it.
+func (sz *Sizing) effectiveDPR(srcSize *Rect) float64 {
+	dpr := sz.DPR
+	if dpr <= 1 {
+		return dpr
+	}
+	lowered := false
+	if w := sz.Size.Width; w > 0 && float64(w)*dpr > float64(srcSize.Width) {
+		dpr = float64(srcSize.Width) / float64(w)
+		lowered = true
+	}
+	if h := sz.Size.Height; h > 0 && float64(h)*dpr > float64(srcSize.Height) {
+		dpr = float64(srcSize.Height) / float64(h)
+		lowered = true
+	}
+	if !lowered {
+		return dpr
+	}
+	if dpr < 1 {
+		return 1
+	}
+	return math.Floor(dpr*100) / 100
+}
+
 // Returns the length rounded to the nearest multiple of the granularity
 // For example a length of 83 and a granularity of 5 would return 85
 func (sz *Sizing) granularize(length int) int {
@@ -264,7 +550,7 @@ func (sz *Sizing) SetFromQuery(q string) error {
 	if size != "" && size != "x" {
 		sz.Size, err = NewRectFromQuery(size)
 		if err != nil {
-			return err
+			return &SizingError{"size", size, "invalid size"}
 		}
 	}
 
@@ -273,14 +559,129 @@ func (sz *Sizing) SetFromQuery(q string) error {
 	if canvas != "" && canvas != "x" {
 		sz.Canvas, err = NewRectFromQuery(canvas)
 		if err != nil {
+			return &SizingError{"canvas", canvas, "invalid size"}
+		}
+		sz.Canvas.Width = min(sz.Canvas.Width, CanvasMaxSize)
+		sz.Canvas.Height = min(sz.Canvas.Height, CanvasMaxSize)
+	}
+
+	// Background and gravity of a padded image
+	if bg := query.Get("bg"); bg != "" {
+		c, err := ParseColor(bg)
+		if err != nil {
+			return &SizingError{"bg", bg, "invalid color"}
+		}
+		sz.Background = &c
+	}
+	sz.Gravity = strings.ToLower(query.Get("gravity"))
+	if g, ok := gravityNames[sz.Gravity]; ok {
+		sz.Gravity = g
+	}
+
+	// Device pixel ratio
+	if dpr := query.Get("dpr"); dpr != "" {
+		sz.DPR, err = strconv.ParseFloat(dpr, 64)
+		if err != nil {
+			return &SizingError{"dpr", dpr, "must be a number"}
+		}
+	}
+
+	// Rotation and flip
+	if rot := query.Get("rot"); rot != "" {
+		sz.Rotate, err = strconv.ParseFloat(rot, 64)
+		if err != nil {
+			return &SizingError{"rot", rot, "must be a number"}
+		}
+		sz.Rotate = math.Mod(sz.Rotate, 360)
+		if sz.Rotate < 0 {
+			sz.Rotate += 360
+		}
+	}
+	switch flip := strings.ToLower(query.Get("flip")); flip {
+	case "vh":
+		sz.Flip = "hv"
+	default:
+		sz.Flip = flip
+	}
+
+	// Resampling filter and unsharp mask
+	sz.Filter = strings.ToLower(query.Get("filter"))
+	if usm := query.Get("usm"); usm != "" {
+		sz.Unsharp, err = NewUnsharpMaskFromQuery(usm)
+		if err != nil {
+			return &SizingError{"usm", usm, "must be radius,sigma,amount[,threshold]"}
+		}
+	}
+
+	// Text
+	if txt := query.Get("txt"); txt != "" {
+		sz.Text = newText(txt)
+		if err := sz.Text.setFromQuery(query); err != nil {
 			return err
 		}
-		sz.Canvas.Width = min(sz.Canvas.Width, canvasMaxSize)
-		sz.Canvas.Height = min(sz.Canvas.Height, canvasMaxSize)
+	}
+
+	// Watermark
+	if wm := query.Get("wm"); wm != "" {
+		sz.Watermark = &Watermark{Image: wm, Gravity: "se", Alpha: 1}
+		if pos := strings.ToLower(query.Get("wm_pos")); pos != "" {
+			if g, ok := gravityNames[pos]; ok {
+				pos = g
+			}
+			sz.Watermark.Gravity = pos
+		}
+		if v := query.Get("wm_scale"); v != "" {
+			sz.Watermark.Scale, err = strconv.ParseFloat(v, 64)
+			if err != nil {
+				return &SizingError{"wm_scale", v, "must be a number"}
+			}
+		}
+		if v := query.Get("wm_alpha"); v != "" {
+			sz.Watermark.Alpha, err = strconv.ParseFloat(v, 64)
+			if err != nil {
+				return &SizingError{"wm_alpha", v, "must be a number"}
+			}
+		}
+		if v := query.Get("wm_margin"); v != "" {
+			sz.Watermark.Margin, err = strconv.Atoi(v)
+			if err != nil {
+				return &SizingError{"wm_margin", v, "must be an integer"}
+			}
+		}
+	}
+
+	// Adjustments
+	if gray := query.Get("gray"); gray != "" {
+		sz.Grayscale, err = strconv.ParseBool(gray)
+		if err != nil {
+			return &SizingError{"gray", gray, "must be a boolean"}
+		}
+	}
+	for _, p := range []struct {
+		key string
+		v   *int
+	}{{"bri", &sz.Brightness}, {"con", &sz.Contrast}, {"sat", &sz.Saturation}} {
+		if v := query.Get(p.key); v != "" {
+			*p.v, err = strconv.Atoi(v)
+			if err != nil {
+				return &SizingError{p.key, v, "must be an integer"}
+			}
+		}
+	}
+	for _, p := range []struct {
+		key string
+		v   *float64
+	}{{"gamma", &sz.Gamma}, {"blur", &sz.Blur}, {"sharpen", &sz.Sharpen}} {
+		if v := query.Get(p.key); v != "" {
+			*p.v, err = strconv.ParseFloat(v, 64)
+			if err != nil {
+				return &SizingError{p.key, v, "must be a number"}
+			}
+		}
 	}
 
 	// Sizing operation
-	sz.Op = query.Get("op")
+	sz.Op = strings.ToLower(query.Get("op"))
 
 	// Quality
 	sz.Quality = 75
@@ -288,7 +689,7 @@ func (sz *Sizing) SetFromQuery(q string) error {
 		if query.Get("q") != "" {
 			sz.Quality, err = strconv.Atoi(query.Get("q"))
 			if err != nil {
-				return err
+				return &SizingError{"q", query.Get("q"), "must be an integer"}
 			}
 		}
 	} else {
@@ -300,10 +701,15 @@ func (sz *Sizing) SetFromQuery(q string) error {
 	if fp == "" {
 		fp = query.Get("focal")
 	}
-	if fp != "" {
+	if fp == "auto" {
+		// Same as the auto gravity, unless anchored by another gravity
+		if sz.Gravity == "" {
+			sz.Gravity = "auto"
+		}
+	} else if fp != "" {
 		sz.FocalPoint, err = NewFloatPointFromQuery(fp)
 		if err != nil {
-			return err
+			return &SizingError{"fp", fp, "invalid point"}
 		}
 	}
 
@@ -315,7 +721,7 @@ func (sz *Sizing) SetFromQuery(q string) error {
 	if cb != "" {
 		sz.CropBox, err = NewFloatingRectFromQuery(cb)
 		if err != nil {
-			return err
+			return &SizingError{"cb", cb, "invalid box"}
 		}
 	}
 
@@ -327,7 +733,7 @@ func (sz *Sizing) SetFromQuery(q string) error {
 	if g != "" {
 		sz.Granularity, err = strconv.Atoi(g)
 		if err != nil {
-			return err
+			return &SizingError{"g", g, "must be an integer"}
 		}
 		if sz.Granularity <= 0 {
 			sz.Granularity = DefaultSizingGranularity
@@ -339,9 +745,237 @@ func (sz *Sizing) SetFromQuery(q string) error {
 		sz.Flatten = true
 	}
 
+	// Lossless
+	if v := query.Get("lossless"); v != "" {
+		sz.Lossless, err = strconv.ParseBool(v)
+		if err != nil {
+			return &SizingError{"lossless", v, "must be a boolean"}
+		}
+	}
+
+	// EXIF orientation, applied unless turned off
+	switch query.Get("orient") {
+	case "0", "false":
+		sz.KeepOrientation = true
+	}
+
 	return nil
 }
 
+// SizingLimits bound the sizings that Validate accepts. Zero values don't
+// limit, except for the quality range which defaults to 1-100.
+type SizingLimits struct {
+	MaxWidth   int
+	MaxHeight  int
+	Ops        []string // allowed ops, all of SizingOps when empty
+	Formats    []string // allowed output formats, any when empty
+	MinQuality int
+	MaxQuality int
+	NoText     bool // txt is refused, for engines that can't draw text
+}
+
+// SizingOps are the ops known to CalcResizeRect.
+var SizingOps = []string{"exact", "contain", "contain2", "expand", "cover", "balance", "fitted", "pad", "smart"}
+
+// ResampleFilters are the filters an image can be resized with.
+var ResampleFilters = []string{"lanczos", "mitchell", "catrom", "point", "box", "triangle"}
+
+// Gravities are the places an image can be put at on its canvas, or
+// anchored at when cropped. The auto gravity crops around the focal point
+// of the image.
+var Gravities = []string{"center", "n", "ne", "e", "se", "s", "sw", "w", "nw", "auto"}
+
+var (
+	gravityAnchors = map[string]*FloatPoint{
+		"center": {0.5, 0.5},
+		"n":      {0.5, 0},
+		"ne":     {1, 0},
+		"e":      {1, 0.5},
+		"se":     {1, 1},
+		"s":      {0.5, 1},
+		"sw":     {0, 1},
+		"w":      {0, 0.5},
+		"nw":     {0, 0},
+	}
+
+	gravityNames = map[string]string{
+		"north":     "n",
+		"northeast": "ne",
+		"east":      "e",
+		"southeast": "se",
+		"south":     "s",
+		"southwest": "sw",
+		"west":      "w",
+		"northwest": "nw",
+	}
+)
+
+// SizingError is a sizing parameter rejected by Validate, named by its
+// query key.
+type SizingError struct {
+	Param  string `json:"param"`
+	Value  string `json:"value"`
+	Reason string `json:"error"`
+}
+
+func (e *SizingError) Error() string {
+	return fmt.Sprintf("invalid %s param %q: %s", e.Param, e.Value, e.Reason)
+}
+
+// Validate checks the sizing against limits, which may be nil, returning
+// a *SizingError for the first bad parameter.
+func (sz *Sizing) Validate(limits *SizingLimits) error {
+	if limits == nil {
+		limits = &SizingLimits{}
+	}
+
+	// A DPR of 0 is unset, the same as 1
+	if sz.DPR != 0 && !(sz.DPR >= 1 && sz.DPR <= maxDPR) {
+		return &SizingError{"dpr", strconv.FormatFloat(sz.DPR, 'f', -1, 64), fmt.Sprintf("dpr must be within 1-%g", maxDPR)}
+	}
+
+	if sz.Size != nil {
+		if err := validateRect("size", sz.Size, sz.scale(sz.Size), limits); err != nil {
+			return err
+		}
+	}
+	if sz.Canvas != nil {
+		if err := validateRect("canvas", sz.Canvas, sz.ScaledCanvas(), limits); err != nil {
+			return err
+		}
+	}
+
+	if sz.Op != "" {
+		ops := limits.Ops
+		if len(ops) == 0 {
+			ops = SizingOps
+		}
+		if !contains(SizingOps, sz.Op) {
+			return &SizingError{"op", sz.Op, "unknown op"}
+		}
+		if !contains(ops, sz.Op) {
+			return &SizingError{"op", sz.Op, "op is not allowed"}
+		}
+	}
+
+	if sz.Gravity != "" && !contains(Gravities, sz.Gravity) {
+		return &SizingError{"gravity", sz.Gravity, "unknown gravity"}
+	}
+
+	if math.IsNaN(sz.Rotate) || math.IsInf(sz.Rotate, 0) || sz.Rotate < 0 || sz.Rotate >= 360 {
+		return &SizingError{"rot", strconv.FormatFloat(sz.Rotate, 'f', -1, 64), "rotation must be within 0-360"}
+	}
+	switch sz.Flip {
+	case "", "h", "v", "hv":
+	default:
+		return &SizingError{"flip", sz.Flip, "flip must be h, v or hv"}
+	}
+
+	if sz.Filter != "" && !contains(ResampleFilters, sz.Filter) {
+		return &SizingError{"filter", sz.Filter, "unknown filter"}
+	}
+	if usm := sz.Unsharp; usm != nil {
+		if err := usm.validate(); err != nil {
+			return err
+		}
+	}
+
+	if err := sz.validateAdjustments(); err != nil {
+		return err
+	}
+
+	if txt := sz.Text; txt != nil {
+		if limits.NoText {
+			return &SizingError{"txt", txt.Text, "text is not supported"}
+		}
+		if err := txt.validate(); err != nil {
+			return err
+		}
+	}
+	if wm := sz.Watermark; wm != nil {
+		if err := wm.validate(); err != nil {
+			return err
+		}
+	}
+
+	if sz.Format != "" && sz.Format != FormatAuto && len(limits.Formats) > 0 && !contains(limits.Formats, sz.Format) {
+		return &SizingError{"format", sz.Format, "format is not allowed"}
+	}
+
+	// A quality of 0 leaves the quality of the image as is
+	if sz.Quality != 0 {
+		minQ, maxQ := limits.MinQuality, limits.MaxQuality
+		if minQ <= 0 {
+			minQ = 1
+		}
+		if maxQ <= 0 || maxQ > 100 {
+			maxQ = 100
+		}
+		if sz.Quality < minQ || sz.Quality > maxQ {
+			return &SizingError{"q", strconv.Itoa(sz.Quality), fmt.Sprintf("quality must be within %d-%d", minQ, maxQ)}
+		}
+	}
+
+	if fp := sz.FocalPoint; fp != nil {
+		if fp.X < 0 || fp.Y < 0 {
+			return &SizingError{"fp", fp.ToString(), "focal point must not be negative"}
+		}
+	}
+
+	if cb := sz.CropBox; cb != nil && !cb.Equal(ZeroFloatingRect) {
+		if cb.Min.X < 0 || cb.Min.Y < 0 {
+			return &SizingError{"cb", cb.ToString(), "crop box must not be negative"}
+		}
+		if cb.Max.X < cb.Min.X || cb.Max.Y < cb.Min.Y {
+			return &SizingError{"cb", cb.ToString(), "crop box max is less than its min"}
+		}
+		if cb.Max.X == cb.Min.X || cb.Max.Y == cb.Min.Y {
+			return &SizingError{"cb", cb.ToString(), "crop box is empty"}
+		}
+	}
+
+	return nil
+}
+
+func (sz *Sizing) validateAdjustments() error {
+	for _, p := range []struct {
+		key string
+		v   int
+	}{{"bri", sz.Brightness}, {"con", sz.Contrast}, {"sat", sz.Saturation}} {
+		if p.v < -100 || p.v > 100 {
+			return &SizingError{p.key, strconv.Itoa(p.v), "must be within -100-100"}
+		}
+	}
+	for _, p := range []struct {
+		key      string
+		v        float64
+		min, max float64
+	}{{"gamma", sz.Gamma, 0.1, 10}, {"blur", sz.Blur, 0, maxBlur}, {"sharpen", sz.Sharpen, 0, maxSharpen}} {
+		// Zero leaves the image as is
+		if p.v == 0 {
+			continue
+		}
+		if !(p.v >= p.min && p.v <= p.max) {
+			return &SizingError{p.key, strconv.FormatFloat(p.v, 'f', -1, 64), fmt.Sprintf("must be within %g-%g", p.min, p.max)}
+		}
+	}
+	return nil
+}
+
+// validateRect checks the asked rect r, limiting its size in pixels.
+func validateRect(param string, r, pixels *Rect, limits *SizingLimits) error {
+	switch {
+	case r.Width < 0 || r.Height < 0:
+		return &SizingError{param, r.ToString(), "size must not be negative"}
+	case limits.MaxWidth > 0 && pixels.Width > limits.MaxWidth:
+		return &SizingError{param, r.ToString(), fmt.Sprintf("width is over %d", limits.MaxWidth)}
+	case limits.MaxHeight > 0 && pixels.Height > limits.MaxHeight:
+		return &SizingError{param, r.ToString(), fmt.Sprintf("height is over %d", limits.MaxHeight)}
+	default:
+		return nil
+	}
+}
+
 func (sz *Sizing) ToQuery() url.Values {
 	u := url.Values{}
 
@@ -351,9 +985,61 @@ func (sz *Sizing) ToQuery() url.Values {
 	if sz.Canvas != nil {
 		u.Add("canvas", sz.Canvas.ToString())
 	}
+	if sz.DPR != 0 && sz.DPR != 1 {
+		u.Add("dpr", strconv.FormatFloat(sz.DPR, 'f', -1, 64))
+	}
 	if sz.Op != "" {
 		u.Add("op", sz.Op)
 	}
+	if sz.Background != nil {
+		u.Add("bg", FormatColor(*sz.Background))
+	}
+	if sz.Gravity != "" {
+		u.Add("gravity", sz.Gravity)
+	}
+	if sz.Rotate != 0 {
+		u.Add("rot", strconv.FormatFloat(sz.Rotate, 'f', -1, 64))
+	}
+	if sz.Flip != "" {
+		u.Add("flip", sz.Flip)
+	}
+	if sz.Filter != "" {
+		u.Add("filter", sz.Filter)
+	}
+	if sz.Unsharp != nil {
+		u.Add("usm", sz.Unsharp.ToString())
+	}
+	if sz.Grayscale {
+		u.Add("gray", "1")
+	}
+	for key, v := range map[string]int{"bri": sz.Brightness, "con": sz.Contrast, "sat": sz.Saturation} {
+		if v != 0 {
+			u.Add(key, strconv.Itoa(v))
+		}
+	}
+	for key, v := range map[string]float64{"gamma": sz.Gamma, "blur": sz.Blur, "sharpen": sz.Sharpen} {
+		if v != 0 {
+			u.Add(key, strconv.FormatFloat(v, 'f', -1, 64))
+		}
+	}
+	if sz.Text != nil {
+		sz.Text.addToQuery(u)
+	}
+	if wm := sz.Watermark; wm != nil {
+		u.Add("wm", wm.Image)
+		if wm.Gravity != "se" {
+			u.Add("wm_pos", wm.Gravity)
+		}
+		if wm.Scale != 0 {
+			u.Add("wm_scale", strconv.FormatFloat(wm.Scale, 'f', -1, 64))
+		}
+		if wm.Alpha != 1 {
+			u.Add("wm_alpha", strconv.FormatFloat(wm.Alpha, 'f', -1, 64))
+		}
+		if wm.Margin != 0 {
+			u.Add("wm_margin", strconv.Itoa(wm.Margin))
+		}
+	}
 	if sz.Quality != 0 {
 		u.Add("q", strconv.Itoa(sz.Quality))
 	}
@@ -372,6 +1058,12 @@ func (sz *Sizing) ToQuery() url.Values {
 	if sz.Flatten {
 		u.Add("flatten", "1")
 	}
+	if sz.Lossless {
+		u.Add("lossless", "1")
+	}
+	if sz.KeepOrientation {
+		u.Add("orient", "0")
+	}
 
 	return u
 }
@@ -451,7 +1143,7 @@ func NewFloatingRectFromQuery(q string) (*FloatingRect, error) {
 
 	mm := strings.Split(q, ",")
 	if len(mm) != 4 {
-		return nil, fmt.Errorf("invalid floating rect query:", q)
+		return nil, fmt.Errorf("invalid floating rect query: %s", q)
 	}
 
 	var err error
@@ -529,6 +1221,95 @@ func (f *FloatPoint) ToString() string {
 	return fmt.Sprintf("%1.0f,%1.0f", f.X, f.Y) // Whole
 }
 
+// UnsharpMask sharpens an image by adding back Amount times the details
+// that a gaussian blur of Radius and Sigma takes away, where they differ by
+// more than Threshold, a fraction of the full range. A Radius of 0 is
+// picked from the Sigma.
+type UnsharpMask struct {
+	Radius, Sigma, Amount, Threshold float64
+}
+
+// NewUnsharpMaskFromQuery parses "radius,sigma,amount[,threshold]".
+func NewUnsharpMaskFromQuery(q string) (*UnsharpMask, error) {
+	parts := strings.Split(q, ",")
+	if len(parts) != 3 && len(parts) != 4 {
+		return nil, fmt.Errorf("invalid unsharp mask query: %s", q)
+	}
+
+	var v [4]float64
+	for n, p := range parts {
+		f, err := strconv.ParseFloat(strings.TrimSpace(p), 64)
+		if err != nil {
+			return nil, err
+		}
+		v[n] = f
+	}
+	return &UnsharpMask{v[0], v[1], v[2], v[3]}, nil
+}
+
+// Returns a comma delimited string of the radius, sigma, amount and
+// threshold (ie. "0,1,1.5,0.02")
+func (u *UnsharpMask) ToString() string {
+	v := []string{}
+	for _, f := range []float64{u.Radius, u.Sigma, u.Amount, u.Threshold} {
+		v = append(v, strconv.FormatFloat(f, 'f', -1, 64))
+	}
+	return strings.Join(v, ",")
+}
+
+func (u *UnsharpMask) validate() error {
+	switch {
+	case !(u.Radius >= 0 && u.Radius <= 3*maxSharpen):
+		return &SizingError{"usm", u.ToString(), fmt.Sprintf("radius must be within 0-%g", 3*maxSharpen)}
+	case !(u.Sigma > 0 && u.Sigma <= maxSharpen):
+		return &SizingError{"usm", u.ToString(), fmt.Sprintf("sigma must be over 0, up to %g", maxSharpen)}
+	case !(u.Amount >= 0 && u.Amount <= 5):
+		return &SizingError{"usm", u.ToString(), "amount must be within 0-5"}
+	case !(u.Threshold >= 0 && u.Threshold <= 1):
+		return &SizingError{"usm", u.ToString(), "threshold must be within 0-1"}
+	}
+	return nil
+}
+
+// Watermark is an image stored in imgry, composited onto a sized image.
+type Watermark struct {
+	Image   string  // The overlay, as "<bucket>/<key>"
+	Gravity string  // Where it goes, se by default
+	Scale   float64 // Its width as a fraction of the image, 0 keeps its own
+	Alpha   float64 // Its opacity, from 0 to 1
+	Margin  int     // Space kept to the edges, multiplied by the DPR
+
+	// The encoded overlay, loaded by whoever knows where Image is stored.
+	// It isn't part of the query.
+	Data []byte
+}
+
+// Location returns the bucket and key of the overlay.
+func (wm *Watermark) Location() (bucket, key string) {
+	n := strings.LastIndex(wm.Image, "/")
+	if n < 0 {
+		return "", wm.Image
+	}
+	return wm.Image[:n], wm.Image[n+1:]
+}
+
+func (wm *Watermark) validate() error {
+	bucket, key := wm.Location()
+	switch {
+	case bucket == "" || key == "":
+		return &SizingError{"wm", wm.Image, "watermark must be <bucket>/<key>"}
+	case wm.Gravity == "auto" || !contains(Gravities, wm.Gravity):
+		return &SizingError{"wm_pos", wm.Gravity, "unknown gravity"}
+	case !(wm.Scale >= 0 && wm.Scale <= 1):
+		return &SizingError{"wm_scale", strconv.FormatFloat(wm.Scale, 'f', -1, 64), "scale must be within 0-1"}
+	case !(wm.Alpha >= 0 && wm.Alpha <= 1):
+		return &SizingError{"wm_alpha", strconv.FormatFloat(wm.Alpha, 'f', -1, 64), "alpha must be within 0-1"}
+	case wm.Margin < 0:
+		return &SizingError{"wm_margin", strconv.Itoa(wm.Margin), "margin must not be negative"}
+	}
+	return nil
+}
+
 // Rounding function for float64 numbers
 func round(in float64) int {
 	if in < 0 {
@@ -542,3 +1323,12 @@ func round(in float64) int {
 func min(first, second int) int {
 	return int(math.Min(float64(first), float64(second)))
 }
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
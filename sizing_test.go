@@ -2,6 +2,7 @@ package imgry
 
 import (
 	"image"
+	"image/color"
 	"net/url"
 	"testing"
 
@@ -197,6 +198,9 @@ func TestCover(t *testing.T) {
 	assert.NotNil(t, point)
 	expected := NewRect(300, 200)
 	assert.Equal(t, expected, result)
+
+	// The default focal point isn't left on the sizing, it'd change its query
+	assert.Nil(t, sz.FocalPoint)
 }
 
 func TestCover2(t *testing.T) {
@@ -241,6 +245,7 @@ func TestBalance(t *testing.T) {
 	assert.NotNil(t, point)
 	expected := NewRect(300, 200)
 	assert.Equal(t, expected, result)
+	assert.Nil(t, s.FocalPoint)
 }
 
 func TestBalance2(t *testing.T) {
@@ -343,3 +348,517 @@ func TestIssue10Canvas(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, expected, result)
 }
+
+func TestValidate(t *testing.T) {
+	limits := &SizingLimits{
+		MaxWidth:   2000,
+		MaxHeight:  2000,
+		Ops:        []string{"exact", "cover"},
+		Formats:    []string{"jpg", "png"},
+		MaxQuality: 95,
+	}
+
+	tests := []struct {
+		query string
+		param string
+	}{
+		{"s=500x500&op=cover&format=png&q=90", ""},
+		{"s=500x500&hq=1", ""},
+		{"s=-5x100", "size"},
+		{"s=3000x", "size"},
+		{"s=100x100&canvas=-10x100", "canvas"},
+		{"s=100x100&q=500", "q"},
+		{"s=100x100&q=-1", "q"},
+		{"s=100x100&op=unknown", "op"},
+		{"s=100x100&op=COVER", ""},
+		{"s=100x100&op=balance", "op"},
+		{"s=100x100&format=tiff", "format"},
+		{"cb=0.9,0.9,0.1,0.1", "cb"},
+		{"cb=-0.1,0,0.5,0.5", "cb"},
+		{"s=300x&cb=0.5,0,0.5,1", "cb"},
+		{"s=300x&op=cover&cb=0,0.2,1,0.2", "cb"},
+		{"fp=-1,0.5", "fp"},
+	}
+
+	for _, tt := range tests {
+		sz, err := NewSizingFromQuery(tt.query)
+		assert.NoError(t, err, tt.query)
+
+		err = sz.Validate(limits)
+		if tt.param == "" {
+			assert.NoError(t, err, tt.query)
+			continue
+		}
+		if assert.IsType(t, &SizingError{}, err, tt.query) {
+			assert.Equal(t, tt.param, err.(*SizingError).Param, tt.query)
+		}
+	}
+
+	// Without limits any known op is fine
+	sz, _ := NewSizingFromQuery("s=5000x5000&op=balance")
+	assert.NoError(t, sz.Validate(nil))
+}
+
+func TestDPR(t *testing.T) {
+	sz, err := NewSizingFromQuery("s=300x200&dpr=2")
+	assert.NoError(t, err)
+	assert.Equal(t, 2.0, sz.DPR)
+	assert.Equal(t, NewRect(600, 400), sz.ScaledSize())
+
+	result, _, _ := sz.CalcResizeRect(testRect4)
+	assert.Equal(t, NewRect(600, 400), result)
+	assert.Equal(t, "2", sz.ToQuery().Get("dpr"))
+
+	// The DPR doesn't upscale past the source
+	sz, _ = NewSizingFromQuery("s=300x&dpr=2&g=1")
+	sz.ResolveDPR(NewRect(500, 400))
+	result, _, _ = sz.CalcResizeRect(NewRect(500, 400))
+	assert.Equal(t, 1.66, sz.DPR)
+	assert.Equal(t, 498, result.Width)
+
+	// ..but the asked size still does
+	sz, _ = NewSizingFromQuery("s=800x&dpr=3&g=1")
+	sz.ResolveDPR(NewRect(500, 400))
+	result, _, _ = sz.CalcResizeRect(NewRect(500, 400))
+	assert.Equal(t, 1.0, sz.DPR)
+	assert.Equal(t, 800, result.Width)
+
+	// Against the cropped source, and only once
+	sz, _ = NewSizingFromQuery("s=300x200&dpr=3&cb=0,0,0.5,0.5")
+	sz.ResolveDPR(NewRect(1600, 1200))
+	assert.Equal(t, 2.66, sz.DPR)
+	sz.ResolveDPR(NewRect(1600, 1200))
+	assert.Equal(t, 2.66, sz.DPR)
+	result, _, _ = sz.CalcResizeRect(NewRect(800, 600))
+	assert.Equal(t, 2.66, sz.DPR)
+
+	// ..and the turned one
+	sz, _ = NewSizingFromQuery("s=300x&dpr=3&rot=90")
+	sz.ResolveDPR(NewRect(1600, 600))
+	assert.Equal(t, 2.0, sz.DPR)
+
+	// Canvas and cover crops are in pixels too
+	sz, _ = NewSizingFromQuery("s=100x100&op=cover&dpr=1.5&g=1")
+	result, crop, _ := sz.CalcResizeRect(testRect4)
+	assert.Equal(t, 150, result.Height)
+	assert.Equal(t, NewRect(150, 150), crop)
+
+	sz, _ = NewSizingFromQuery("s=100x&canvas=200x200&op=fitted&dpr=2")
+	assert.Equal(t, NewRect(400, 400), sz.ScaledCanvas())
+
+	for _, dpr := range []string{"4", "0.01", "0.5", "-1", "NaN"} {
+		sz, _ = NewSizingFromQuery("s=100x&dpr=" + dpr)
+		assert.IsType(t, &SizingError{}, sz.Validate(nil), dpr)
+	}
+	for _, dpr := range []string{"0", "1", "1.5", "3"} {
+		sz, _ = NewSizingFromQuery("s=100x&dpr=" + dpr)
+		assert.NoError(t, sz.Validate(nil), dpr)
+	}
+	sz, _ = NewSizingFromQuery("s=1500x&dpr=2")
+	assert.IsType(t, &SizingError{}, sz.Validate(&SizingLimits{MaxWidth: 2000}))
+}
+
+func TestOpPad(t *testing.T) {
+	sz, err := NewSizingFromQuery("s=400x400&op=pad&bg=%23ff0000&gravity=se")
+	assert.NoError(t, err)
+	assert.NoError(t, sz.Validate(nil))
+
+	result, _, _ := sz.CalcResizeRect(NewRect(1600, 480))
+	assert.Equal(t, NewRect(400, 120), result)
+
+	canvas, origin := sz.CalcCanvas(result)
+	assert.Equal(t, NewRect(400, 400), canvas)
+	assert.Equal(t, &image.Point{0, 280}, origin)
+
+	sz.Gravity = ""
+	_, origin = sz.CalcCanvas(result)
+	assert.Equal(t, &image.Point{0, 140}, origin)
+
+	assert.Equal(t, "ff0000", sz.ToQuery().Get("bg"))
+	assert.Equal(t, color.NRGBA{0xff, 0, 0, 0xff}, sz.FillColor("png"))
+
+	sz.Background = nil
+	assert.Equal(t, Transparent, sz.FillColor("png"))
+	assert.Equal(t, White, sz.FillColor("jpg"))
+
+	// Without a canvas or padding there's nothing to place the image on
+	sz, _ = NewSizingFromQuery("s=400x400")
+	canvas, _ = sz.CalcCanvas(result)
+	assert.Nil(t, canvas)
+
+	sz, _ = NewSizingFromQuery("s=400x400&op=pad&gravity=up")
+	assert.IsType(t, &SizingError{}, sz.Validate(nil))
+	_, err = NewSizingFromQuery("s=400x400&op=pad&bg=nope")
+	assert.IsType(t, &SizingError{}, err)
+}
+
+func TestGravity(t *testing.T) {
+	tests := []struct {
+		query  string
+		origin image.Point
+	}{
+		{"s=100x100&op=cover", image.Point{50, 0}},
+		{"s=100x100&op=cover&gravity=west", image.Point{0, 0}},
+		{"s=100x100&op=cover&gravity=East", image.Point{100, 0}},
+		{"s=100x100&op=cover&gravity=ne", image.Point{100, 0}},
+		{"s=100x100&op=cover&gravity=w&fp=0.9,0.5", image.Point{0, 0}},
+		{"s=100x100&op=balance&gravity=center", image.Point{50, 0}},
+	}
+
+	for _, tt := range tests {
+		sz, err := NewSizingFromQuery(tt.query)
+		assert.NoError(t, err, tt.query)
+		assert.NoError(t, sz.Validate(nil), tt.query)
+
+		_, _, origin := sz.CalcResizeRect(NewRect(400, 200))
+		assert.Equal(t, tt.origin, *origin, tt.query)
+	}
+
+	// Tall images are anchored vertically
+	sz, _ := NewSizingFromQuery("s=100x100&op=cover&gravity=south")
+	_, _, origin := sz.CalcResizeRect(NewRect(200, 400))
+	assert.Equal(t, image.Point{0, 100}, *origin)
+	assert.Equal(t, "s", sz.ToQuery().Get("gravity"))
+
+	// The auto gravity leaves the focal point to the engine
+	sz, _ = NewSizingFromQuery("s=100x100&op=cover&gravity=auto")
+	assert.True(t, sz.NeedsFocalPoint())
+	sz.CalcResizeRect(NewRect(400, 200))
+	assert.Nil(t, sz.FocalPoint)
+
+	sz.FocalPoint = NewFloatPoint(1, 0.5)
+	_, _, origin = sz.CalcResizeRect(NewRect(400, 200))
+	assert.Equal(t, image.Point{100, 0}, *origin)
+	assert.False(t, sz.NeedsFocalPoint())
+}
+
+func TestOpSmart(t *testing.T) {
+	sz, err := NewSizingFromQuery("s=100x100&op=smart")
+	assert.NoError(t, err)
+	assert.NoError(t, sz.Validate(nil))
+	assert.True(t, sz.NeedsFocalPoint())
+
+	// Without a focal point yet, the crop is centered
+	_, _, origin := sz.CalcResizeRect(NewRect(400, 200))
+	assert.Equal(t, image.Point{50, 0}, *origin)
+	assert.Nil(t, sz.FocalPoint)
+
+	sz.FocalPoint = NewFloatPoint(0.2, 0.5)
+	assert.False(t, sz.NeedsFocalPoint())
+	_, _, origin = sz.CalcResizeRect(NewRect(400, 200))
+	assert.Equal(t, image.Point{0, 0}, *origin)
+
+	// Anchored smart crops don't need one
+	sz, _ = NewSizingFromQuery("s=100x100&op=smart&gravity=e")
+	assert.False(t, sz.NeedsFocalPoint())
+
+	// fp=auto is the auto gravity
+	sz, _ = NewSizingFromQuery("s=100x100&op=cover&fp=auto")
+	assert.Equal(t, "auto", sz.Gravity)
+	assert.Nil(t, sz.FocalPoint)
+	assert.True(t, sz.NeedsFocalPoint())
+
+	// A point found on reframed frames isn't the one of the source
+	assert.False(t, sz.ReframesSource())
+	for _, q := range []string{"s=300x300&op=smart&cb=0.5,0,1,1", "s=300x300&op=smart&rot=90", "s=300x300&op=smart&flip=h"} {
+		sz, _ = NewSizingFromQuery(q)
+		assert.True(t, sz.ReframesSource(), q)
+	}
+}
+
+func TestOrient(t *testing.T) {
+	sz, err := NewSizingFromQuery("s=100x")
+	assert.NoError(t, err)
+	assert.False(t, sz.KeepOrientation)
+	assert.Equal(t, "", sz.ToQuery().Get("orient"))
+
+	sz, err = NewSizingFromQuery("s=100x&orient=0")
+	assert.NoError(t, err)
+	assert.True(t, sz.KeepOrientation)
+	assert.Equal(t, "0", sz.ToQuery().Get("orient"))
+}
+
+func TestRotateFlip(t *testing.T) {
+	sz, err := NewSizingFromQuery("s=100x&rot=-90&flip=VH")
+	assert.NoError(t, err)
+	assert.Equal(t, float64(270), sz.Rotate)
+	assert.Equal(t, "hv", sz.Flip)
+	assert.NoError(t, sz.Validate(nil))
+
+	q := sz.ToQuery()
+	assert.Equal(t, "270", q.Get("rot"))
+	assert.Equal(t, "hv", q.Get("flip"))
+
+	sz2, err := NewSizingFromQuery(q.Encode())
+	assert.NoError(t, err)
+	assert.Equal(t, q.Encode(), sz2.ToQuery().Encode())
+
+	sz, _ = NewSizingFromQuery("rot=720")
+	assert.Equal(t, float64(0), sz.Rotate)
+	assert.Equal(t, "", sz.ToQuery().Get("rot"))
+	assert.False(t, sz.Transforms())
+
+	sz, _ = NewSizingFromQuery("flip=x")
+	err = sz.Validate(nil)
+	assert.Error(t, err)
+	assert.Equal(t, "flip", err.(*SizingError).Param)
+
+	sz, _ = NewSizingFromQuery("rot=nan")
+	err = sz.Validate(nil)
+	assert.Error(t, err)
+	assert.Equal(t, "rot", err.(*SizingError).Param)
+
+	tests := []struct {
+		rot      string
+		expected *Rect
+	}{
+		{"0", NewRect(400, 200)},
+		{"90", NewRect(200, 400)},
+		{"180", NewRect(400, 200)},
+		{"-90", NewRect(200, 400)},
+		{"45", NewRect(424, 424)},
+	}
+	for _, tt := range tests {
+		sz, _ := NewSizingFromQuery("rot=" + tt.rot)
+		assert.Equal(t, tt.expected, sz.RotatedSize(NewRect(400, 200)), "rot="+tt.rot)
+	}
+}
+
+func TestAdjustments(t *testing.T) {
+	sz, err := NewSizingFromQuery("s=100x&gray=1&bri=10&con=-20&sat=30&gamma=1.2&blur=2.5&sharpen=1")
+	assert.NoError(t, err)
+	assert.True(t, sz.Grayscale)
+	assert.Equal(t, 10, sz.Brightness)
+	assert.Equal(t, -20, sz.Contrast)
+	assert.Equal(t, 30, sz.Saturation)
+	assert.Equal(t, 1.2, sz.Gamma)
+	assert.Equal(t, 2.5, sz.Blur)
+	assert.Equal(t, float64(1), sz.Sharpen)
+	assert.True(t, sz.Adjusts())
+	assert.NoError(t, sz.Validate(nil))
+
+	// The canonical query doesn't depend on the order of the params
+	sz2, err := NewSizingFromQuery("sharpen=1&blur=2.5&gamma=1.2&sat=30&con=-20&bri=10&gray=true&s=100x")
+	assert.NoError(t, err)
+	assert.Equal(t, sz.ToQuery().Encode(), sz2.ToQuery().Encode())
+	assert.Equal(t, "blur=2.5&bri=10&con=-20&g=10&gamma=1.2&gray=1&q=75&s=100x0&sat=30&sharpen=1", sz.ToQuery().Encode())
+
+	sz, _ = NewSizingFromQuery("s=100x&gray=0")
+	assert.False(t, sz.Adjusts())
+	assert.Equal(t, "", sz.ToQuery().Get("gray"))
+
+	var tests = []struct {
+		query string
+		param string
+	}{
+		{"bri=101", "bri"},
+		{"con=-101", "con"},
+		{"sat=200", "sat"},
+		{"gamma=0.01", "gamma"},
+		{"gamma=nan", "gamma"},
+		{"blur=-1", "blur"},
+		{"blur=51", "blur"},
+		{"sharpen=11", "sharpen"},
+	}
+	for _, tt := range tests {
+		sz, err := NewSizingFromQuery(tt.query)
+		assert.NoError(t, err)
+		err = sz.Validate(nil)
+		if assert.Error(t, err, tt.query) {
+			assert.Equal(t, tt.param, err.(*SizingError).Param, tt.query)
+		}
+	}
+
+	_, err = NewSizingFromQuery("gray=maybe")
+	assert.Error(t, err)
+}
+
+func TestResampling(t *testing.T) {
+	sz, err := NewSizingFromQuery("s=100x&filter=Point&usm=0,1.5,0.8")
+	assert.NoError(t, err)
+	assert.Equal(t, "point", sz.Filter)
+	assert.Equal(t, &UnsharpMask{0, 1.5, 0.8, 0}, sz.Unsharp)
+	assert.NoError(t, sz.Validate(nil))
+
+	q := sz.ToQuery()
+	assert.Equal(t, "point", q.Get("filter"))
+	assert.Equal(t, "0,1.5,0.8,0", q.Get("usm"))
+
+	sz2, err := NewSizingFromQuery(q.Encode())
+	assert.NoError(t, err)
+	assert.Equal(t, sz.Unsharp, sz2.Unsharp)
+
+	_, err = NewSizingFromQuery("usm=1,2")
+	assert.Error(t, err)
+
+	var tests = []struct {
+		query string
+		param string
+	}{
+		{"filter=bicubic", "filter"},
+		{"usm=0,0,1", "usm"},
+		{"usm=-1,1,1", "usm"},
+		{"usm=0,1,6", "usm"},
+		{"usm=0,1,1,2", "usm"},
+	}
+	for _, tt := range tests {
+		sz, err := NewSizingFromQuery(tt.query)
+		assert.NoError(t, err)
+		err = sz.Validate(nil)
+		if assert.Error(t, err, tt.query) {
+			assert.Equal(t, tt.param, err.(*SizingError).Param, tt.query)
+		}
+	}
+}
+
+func TestWatermark(t *testing.T) {
+	sz, err := NewSizingFromQuery("s=100x&wm=brand/logo&wm_pos=NorthWest&wm_scale=0.25&wm_alpha=0.5&wm_margin=10")
+	assert.NoError(t, err)
+	assert.NoError(t, sz.Validate(nil))
+	assert.Equal(t, &Watermark{Image: "brand/logo", Gravity: "nw", Scale: 0.25, Alpha: 0.5, Margin: 10}, sz.Watermark)
+
+	bucket, key := sz.Watermark.Location()
+	assert.Equal(t, "brand", bucket)
+	assert.Equal(t, "logo", key)
+
+	q := sz.ToQuery()
+	assert.Equal(t, "brand/logo", q.Get("wm"))
+	assert.Equal(t, "nw", q.Get("wm_pos"))
+	assert.Equal(t, "0.25", q.Get("wm_scale"))
+	assert.Equal(t, "0.5", q.Get("wm_alpha"))
+	assert.Equal(t, "10", q.Get("wm_margin"))
+
+	// Defaults are left out of the query
+	sz, _ = NewSizingFromQuery("wm=brand/logo&wm_pos=se&wm_alpha=1")
+	q = sz.ToQuery()
+	assert.Equal(t, "brand/logo", q.Get("wm"))
+	assert.Equal(t, "", q.Get("wm_pos"))
+	assert.Equal(t, "", q.Get("wm_alpha"))
+	assert.True(t, sz.Transforms())
+
+	var tests = []struct {
+		query  string
+		size   *Rect
+		wm     *Rect
+		scaled *Rect
+		origin image.Point
+	}{
+		{"wm=b/k", NewRect(400, 300), NewRect(100, 50), NewRect(100, 50), image.Point{300, 250}},
+		{"wm=b/k&wm_margin=10", NewRect(400, 300), NewRect(100, 50), NewRect(100, 50), image.Point{290, 240}},
+		{"wm=b/k&wm_margin=10&dpr=2", NewRect(400, 300), NewRect(100, 50), NewRect(100, 50), image.Point{280, 230}},
+		{"wm=b/k&wm_pos=center&wm_scale=0.5", NewRect(400, 300), NewRect(100, 50), NewRect(200, 100), image.Point{100, 100}},
+		{"wm=b/k&wm_pos=nw&wm_margin=5", NewRect(400, 300), NewRect(100, 50), NewRect(100, 50), image.Point{5, 5}},
+		{"wm=b/k&wm_pos=n", NewRect(400, 300), NewRect(100, 50), NewRect(100, 50), image.Point{150, 0}},
+	}
+	for _, tt := range tests {
+		sz, _ := NewSizingFromQuery(tt.query)
+		scaled, origin := sz.CalcWatermark(tt.size, tt.wm)
+		assert.Equal(t, tt.scaled, scaled, tt.query)
+		assert.Equal(t, tt.origin, *origin, tt.query)
+	}
+
+	var errs = []struct {
+		query string
+		param string
+	}{
+		{"wm=logo", "wm"},
+		{"wm=b/", "wm"},
+		{"wm=b/k&wm_pos=auto", "wm_pos"},
+		{"wm=b/k&wm_scale=2", "wm_scale"},
+		{"wm=b/k&wm_alpha=-0.5", "wm_alpha"},
+		{"wm=b/k&wm_margin=-1", "wm_margin"},
+	}
+	for _, tt := range errs {
+		sz, err := NewSizingFromQuery(tt.query)
+		assert.NoError(t, err)
+		err = sz.Validate(nil)
+		if assert.Error(t, err, tt.query) {
+			assert.Equal(t, tt.param, err.(*SizingError).Param, tt.query)
+		}
+	}
+}
+
+func TestWebP(t *testing.T) {
+	sz, err := NewSizingFromQuery("s=100x&format=webp&lossless=1")
+	assert.NoError(t, err)
+	assert.Equal(t, "webp", sz.Format)
+	assert.True(t, sz.Lossless)
+	assert.Equal(t, "1", sz.ToQuery().Get("lossless"))
+
+	sz, err = NewSizingFromQuery("s=100x&format=webp")
+	assert.NoError(t, err)
+	assert.False(t, sz.Lossless)
+	assert.Equal(t, "", sz.ToQuery().Get("lossless"))
+
+	_, err = NewSizingFromQuery("lossless=maybe")
+	assert.Error(t, err)
+
+	// auto is left for the server, whatever the allowed formats
+	sz, err = NewSizingFromQuery("s=100x&format=auto")
+	assert.NoError(t, err)
+	assert.NoError(t, sz.Validate(&SizingLimits{Formats: []string{"jpg"}}))
+	assert.Equal(t, FormatAuto, sz.ToQuery().Get("format"))
+}
+
+func TestAutoFormat(t *testing.T) {
+	assert.Equal(t, "png", AutoFormat(true, 100000))
+	assert.Equal(t, "png", AutoFormat(false, MaxPaletteColors))
+	assert.Equal(t, "jpg", AutoFormat(false, MaxPaletteColors+1))
+}
+
+func TestFillColor(t *testing.T) {
+	sz, _ := NewSizingFromQuery("s=100x100&op=fitted&canvas=200x200")
+	assert.Equal(t, Transparent, sz.FillColor("png"))
+	assert.Equal(t, White, sz.FillColor("jpg"))
+	assert.Equal(t, Transparent, sz.CanvasFill("png"))
+	assert.Equal(t, White, sz.CanvasFill("jpg"))
+
+	// A see-through background turns opaque where nothing can show
+	sz, _ = NewSizingFromQuery("s=100x100&op=fitted&canvas=200x200&bg=ff000080")
+	assert.Equal(t, color.NRGBA{0xff, 0, 0, 0x80}, sz.FillColor("png"))
+	assert.Equal(t, color.NRGBA{0xff, 0, 0, 0xff}, sz.FillColor("jpg"))
+	assert.Equal(t, Transparent, sz.CanvasFill("png"))
+	assert.Equal(t, color.NRGBA{0xff, 0, 0, 0xff}, sz.CanvasFill("jpg"))
+
+	sz, _ = NewSizingFromQuery("s=100x100&op=pad&bg=ff000080")
+	assert.Equal(t, color.NRGBA{0xff, 0, 0, 0x80}, sz.CanvasFill("png"))
+}
+
+func TestQueryParseErrors(t *testing.T) {
+	var tests = []struct {
+		query string
+		param string
+	}{
+		{"s=axb", "size"},
+		{"s=100x&canvas=big", "canvas"},
+		{"s=100x&dpr=two", "dpr"},
+		{"s=100x&rot=left", "rot"},
+		{"s=100x&usm=1", "usm"},
+		{"s=100x&wm=b/k&wm_scale=big", "wm_scale"},
+		{"s=100x&wm=b/k&wm_alpha=half", "wm_alpha"},
+		{"s=100x&wm=b/k&wm_margin=1.5", "wm_margin"},
+		{"s=100x&gray=maybe", "gray"},
+		{"s=100x&bri=lots", "bri"},
+		{"s=100x&gamma=x", "gamma"},
+		{"s=100x&q=high", "q"},
+		{"s=100x&fp=middle", "fp"},
+		{"s=100x&cb=all", "cb"},
+		{"s=100x&g=fine", "g"},
+		{"s=100x&lossless=maybe", "lossless"},
+		{"s=100x&txt=Hi&txt_size=big", "txt_size"},
+	}
+	for _, tt := range tests {
+		_, err := NewSizingFromQuery(tt.query)
+		if assert.IsType(t, &SizingError{}, err, tt.query) {
+			assert.Equal(t, tt.param, err.(*SizingError).Param, tt.query)
+		}
+	}
+}
+
+func TestOpCase(t *testing.T) {
+	sz, _ := NewSizingFromQuery("s=100x100&op=COVER")
+	assert.Equal(t, "cover", sz.Op)
+	result, crop, _ := sz.CalcResizeRect(testRect4)
+	assert.Equal(t, NewRect(100, 100), crop)
+	assert.NotEqual(t, NewRect(100, 100), result)
+}
@@ -0,0 +1,135 @@
+package imgry
+
+import (
+	"fmt"
+	"image/color"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	// Longest text a sizing may draw, in characters
+	maxTextLength = 500
+
+	// Largest point size of a text
+	maxTextSize float64 = 300
+)
+
+// Text is a caption drawn onto a sized image, wrapped to fit its width.
+type Text struct {
+	Text    string
+	Font    string       // File name of a font in the font directory, empty for the default
+	Size    float64      // Point size, multiplied by the DPR
+	Color   color.NRGBA  // White by default
+	Box     *color.NRGBA // Background box, a shadow is drawn without one
+	Gravity string       // Where it goes, s by default
+	Width   float64      // Longest line as a fraction of the image width
+
+	// Path of the font file, resolved by whoever knows the font directory.
+	// It isn't part of the query.
+	FontFile string
+}
+
+func newText(s string) *Text {
+	return &Text{Text: s, Size: 24, Color: White, Gravity: "s", Width: 0.9}
+}
+
+func (t *Text) setFromQuery(query url.Values) error {
+	var err error
+	t.Font = query.Get("txt_font")
+	if v := query.Get("txt_size"); v != "" {
+		if t.Size, err = strconv.ParseFloat(v, 64); err != nil {
+			return &SizingError{"txt_size", v, "must be a number"}
+		}
+	}
+	if v := query.Get("txt_color"); v != "" {
+		if t.Color, err = ParseColor(v); err != nil {
+			return &SizingError{"txt_color", v, "invalid color"}
+		}
+	}
+	if v := query.Get("txt_box"); v != "" {
+		c, err := ParseColor(v)
+		if err != nil {
+			return &SizingError{"txt_box", v, "invalid color"}
+		}
+		t.Box = &c
+	}
+	if v := strings.ToLower(query.Get("txt_pos")); v != "" {
+		if g, ok := gravityNames[v]; ok {
+			v = g
+		}
+		t.Gravity = v
+	}
+	if v := query.Get("txt_width"); v != "" {
+		if t.Width, err = strconv.ParseFloat(v, 64); err != nil {
+			return &SizingError{"txt_width", v, "must be a number"}
+		}
+	}
+	return nil
+}
+
+func (t *Text) addToQuery(u url.Values) {
+	d := newText(t.Text)
+	u.Add("txt", t.Text)
+	if t.Font != "" {
+		u.Add("txt_font", t.Font)
+	}
+	if t.Size != d.Size {
+		u.Add("txt_size", strconv.FormatFloat(t.Size, 'f', -1, 64))
+	}
+	if t.Color != d.Color {
+		u.Add("txt_color", FormatColor(t.Color))
+	}
+	if t.Box != nil {
+		u.Add("txt_box", FormatColor(*t.Box))
+	}
+	if t.Gravity != d.Gravity {
+		u.Add("txt_pos", t.Gravity)
+	}
+	if t.Width != d.Width {
+		u.Add("txt_width", strconv.FormatFloat(t.Width, 'f', -1, 64))
+	}
+}
+
+func (t *Text) validate() error {
+	switch {
+	case utf8.RuneCountInString(t.Text) > maxTextLength:
+		return &SizingError{"txt", t.Text, fmt.Sprintf("text is over %d characters", maxTextLength)}
+	case t.Font != "" && (filepath.Base(t.Font) != t.Font || strings.ContainsAny(t.Font, `/\`) || strings.HasPrefix(t.Font, ".")):
+		return &SizingError{"txt_font", t.Font, "font must be a file name"}
+	case !(t.Size >= 1 && t.Size <= maxTextSize):
+		return &SizingError{"txt_size", strconv.FormatFloat(t.Size, 'f', -1, 64), fmt.Sprintf("size must be within 1-%g", maxTextSize)}
+	case t.Gravity == "auto" || !contains(Gravities, t.Gravity):
+		return &SizingError{"txt_pos", t.Gravity, "unknown gravity"}
+	case !(t.Width > 0 && t.Width <= 1):
+		return &SizingError{"txt_width", strconv.FormatFloat(t.Width, 'f', -1, 64), "width must be over 0, up to 1"}
+	}
+	return nil
+}
+
+// WrapText breaks s into lines no wider than width, as measured by
+// measure, at spaces and at the line breaks it already has. A word that's
+// wider on its own gets a line of its own.
+func WrapText(s string, width float64, measure func(string) float64) []string {
+	var lines []string
+	for _, para := range strings.Split(s, "\n") {
+		line := ""
+		for _, word := range strings.Fields(para) {
+			if line == "" {
+				line = word
+				continue
+			}
+			if measure(line+" "+word) > width {
+				lines = append(lines, line)
+				line = word
+				continue
+			}
+			line += " " + word
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
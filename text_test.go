@@ -0,0 +1,87 @@
+package imgry
+
+import (
+	"image/color"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWrapText(t *testing.T) {
+	// Every character is 10 wide
+	measure := func(s string) float64 { return float64(len(s) * 10) }
+
+	var tests = []struct {
+		text     string
+		width    float64
+		expected []string
+	}{
+		{"hello world", 200, []string{"hello world"}},
+		{"hello world", 100, []string{"hello", "world"}},
+		{"the quick brown fox", 110, []string{"the quick", "brown fox"}},
+		{"a  b\nc", 200, []string{"a b", "c"}},
+		{"extraordinarily long", 50, []string{"extraordinarily", "long"}},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.expected, WrapText(tt.text, tt.width, measure), tt.text)
+	}
+}
+
+func TestText(t *testing.T) {
+	sz, err := NewSizingFromQuery("s=600x&txt=Hello+world&txt_font=Inter.ttf&txt_size=32&txt_color=ff0000&txt_pos=North&txt_width=0.5&txt_box=00000080")
+	assert.NoError(t, err)
+	assert.NoError(t, sz.Validate(nil))
+	assert.Equal(t, &Text{
+		Text:    "Hello world",
+		Font:    "Inter.ttf",
+		Size:    32,
+		Color:   color.NRGBA{0xff, 0, 0, 0xff},
+		Box:     &color.NRGBA{0, 0, 0, 0x80},
+		Gravity: "n",
+		Width:   0.5,
+	}, sz.Text)
+	assert.True(t, sz.Transforms())
+
+	sz2, err := NewSizingFromQuery(sz.ToQuery().Encode())
+	assert.NoError(t, err)
+	assert.Equal(t, sz.Text, sz2.Text)
+
+	// Defaults are left out of the query
+	sz, _ = NewSizingFromQuery("txt=Hi&txt_pos=s&txt_color=fff&dpr=2")
+	q := sz.ToQuery()
+	assert.Equal(t, "Hi", q.Get("txt"))
+	assert.Equal(t, "", q.Get("txt_pos"))
+	assert.Equal(t, "", q.Get("txt_color"))
+	assert.Equal(t, float64(48), sz.ScaledTextSize())
+
+	var errs = []struct {
+		query string
+		param string
+	}{
+		{"txt=Hi&txt_font=../secret.ttf", "txt_font"},
+		{"txt=Hi&txt_font=.hidden", "txt_font"},
+		{"txt=Hi&txt_size=0.5", "txt_size"},
+		{"txt=Hi&txt_pos=auto", "txt_pos"},
+		{"txt=Hi&txt_width=0", "txt_width"},
+	}
+	for _, tt := range errs {
+		sz, err := NewSizingFromQuery(tt.query)
+		assert.NoError(t, err)
+		err = sz.Validate(nil)
+		if assert.Error(t, err, tt.query) {
+			assert.Equal(t, tt.param, err.(*SizingError).Param, tt.query)
+		}
+	}
+
+	_, err = NewSizingFromQuery("txt=Hi&txt_color=nope")
+	assert.Equal(t, "txt_color", err.(*SizingError).Param)
+
+	// Engines that can't draw text refuse it
+	sz, _ = NewSizingFromQuery("s=600x&txt=Hi")
+	err = sz.Validate(&SizingLimits{NoText: true})
+	if assert.Error(t, err) {
+		assert.Equal(t, "txt", err.(*SizingError).Param)
+	}
+	sz, _ = NewSizingFromQuery("s=600x")
+	assert.NoError(t, sz.Validate(&SizingLimits{NoText: true}))
+}
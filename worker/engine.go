@@ -0,0 +1,486 @@
+package worker
+
+import (
+	"context"
+	"encoding/gob"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/goware/go-metrics"
+	"github.com/goware/lg"
+	"github.com/pressly/imgry"
+)
+
+// Engine is an imgry.Engine running every job in one of its worker
+// processes. A worker that crashes, or is killed because it hung, is
+// restarted in the background.
+type Engine struct {
+	// Workers is the number of worker processes, each runs one job at
+	// a time.
+	Workers int
+
+	// Timeout of a single job, after which the worker is considered hung.
+	// Zero lets every job run for as long as it takes.
+	Timeout time.Duration
+
+	// Command returns the command of a worker process, which should call
+	// Serve with the pipes returned by Files.
+	Command func() *exec.Cmd
+
+	tmpDir  string
+	version string
+	formats []string
+	text    bool
+	idle    chan *proc
+
+	mu     sync.Mutex
+	closed bool
+}
+
+// New returns an engine of n worker processes started by command.
+func New(n int, timeout time.Duration, command func() *exec.Cmd) *Engine {
+	return &Engine{Workers: n, Timeout: timeout, Command: command}
+}
+
+func (ng *Engine) Version() string {
+	return fmt.Sprintf("%s (%d workers)", ng.version, ng.Workers)
+}
+
+// Formats are the output formats of the engine of the workers.
+func (ng *Engine) Formats() []string {
+	return ng.formats
+}
+
+// DrawsText reports whether the engine of the workers draws text, see
+// imgry.DrawsText.
+func (ng *Engine) DrawsText() bool {
+	return ng.text
+}
+
+// Initialize starts the workers. Each worker gets its own directory under
+// tmpDir, so that a restarted worker only sweeps the files left over by
+// the one it replaces.
+func (ng *Engine) Initialize(tmpDir string) error {
+	if ng.Workers <= 0 {
+		ng.Workers = 1
+	}
+	if tmpDir != "" {
+		if err := os.MkdirAll(tmpDir, 0755); err != nil {
+			return err
+		}
+	}
+	ng.tmpDir = tmpDir
+	ng.idle = make(chan *proc, ng.Workers)
+
+	for id := 0; id < ng.Workers; id++ {
+		p, err := ng.start(id)
+		if err != nil {
+			for n := len(ng.idle); n > 0; n-- {
+				(<-ng.idle).stop()
+			}
+			return err
+		}
+		ng.version = p.version
+		ng.formats = p.formats
+		ng.text = p.text
+		ng.idle <- p
+	}
+	return nil
+}
+
+// Terminate stops the workers once they're done with their current job.
+func (ng *Engine) Terminate() {
+	ng.mu.Lock()
+	if ng.closed || ng.idle == nil {
+		ng.mu.Unlock()
+		return
+	}
+	ng.closed = true
+	n := ng.Workers
+	ng.mu.Unlock()
+
+	for ; n > 0; n-- {
+		p := <-ng.idle
+		if p != nil {
+			p.stop()
+		}
+	}
+}
+
+func (ng *Engine) LoadFile(filename string, srcFormat ...string) (imgry.Image, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return ng.LoadBlob(context.Background(), b, srcFormat...)
+}
+
+// LoadBlob has a worker decode the image, the blob itself is kept here
+// and sent along with any later job on the image.
+func (ng *Engine) LoadBlob(ctx context.Context, b []byte, srcFormat ...string) (imgry.Image, error) {
+	if len(b) == 0 {
+		return nil, imgry.ErrInvalidImageData
+	}
+
+	var hint string
+	if len(srcFormat) > 0 {
+		hint = srcFormat[0]
+	}
+
+	res, err := ng.do(ctx, &job{Op: opLoad, Blob: b, Format: hint})
+	if err != nil {
+		return nil, err
+	}
+
+	im := &Image{ng: ng, data: b, hint: hint}
+	im.sync(res)
+	return im, nil
+}
+
+func (ng *Engine) GetImageInfo(b []byte, srcFormat ...string) (*imgry.ImageInfo, error) {
+	if len(b) == 0 {
+		return nil, imgry.ErrInvalidImageData
+	}
+
+	var hint string
+	if len(srcFormat) > 0 {
+		hint = srcFormat[0]
+	}
+
+	res, err := ng.do(context.Background(), &job{Op: opInfo, Blob: b, Format: hint})
+	if err != nil {
+		return nil, err
+	}
+	return res.Info, nil
+}
+
+// do runs the job on the next idle worker. The worker is killed, and
+// replaced, if it fails or hangs. When the context is done first, the
+// worker is left to finish the job and back to the idle ones once its
+// result is drained.
+func (ng *Engine) do(ctx context.Context, j *job) (*result, error) {
+	ng.mu.Lock()
+	closed := ng.closed
+	ng.mu.Unlock()
+	if closed {
+		return nil, ErrClosed
+	}
+
+	var p *proc
+	select {
+	case p = <-ng.idle:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if p == nil {
+		// Terminated while we were waiting, pass it on to the others
+		ng.idle <- nil
+		return nil, ErrClosed
+	}
+
+	deadline := ng.deadline()
+	replies := p.send(j)
+	res, err := p.wait(ctx, replies, deadline)
+	if err != nil && err == ctx.Err() {
+		go ng.drain(p, replies, deadline)
+		return nil, err
+	}
+	if err != nil {
+		ng.replace(p, err)
+		return nil, err
+	}
+
+	ng.idle <- p
+	if err := res.err(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// drain waits for the result of the job a worker was left with, the
+// worker is then idle again, or replaced if the job failed or hung.
+func (ng *Engine) drain(p *proc, replies <-chan reply, deadline time.Time) {
+	if _, err := p.wait(context.Background(), replies, deadline); err != nil {
+		ng.replace(p, err)
+		return
+	}
+	ng.idle <- p
+}
+
+// replace kills a failed or hung worker and restarts it.
+func (ng *Engine) replace(p *proc, err error) {
+	p.kill()
+	switch err {
+	case ErrWorkerCrashed:
+		metrics.IncrCounter([]string{"fn.worker.Crashes"}, 1)
+	case ErrWorkerTimeout:
+		metrics.IncrCounter([]string{"fn.worker.Timeouts"}, 1)
+	}
+	lg.Warnf("imgry worker %d stopped: %s", p.id, err)
+	go ng.restart(p.id)
+}
+
+// deadline is when a job started now times out, zero without a Timeout.
+func (ng *Engine) deadline() time.Time {
+	if ng.Timeout <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(ng.Timeout)
+}
+
+// restart starts a replacement of worker id, retrying until it's up or
+// the engine is terminated.
+func (ng *Engine) restart(id int) {
+	for wait := 100 * time.Millisecond; ; wait *= 2 {
+		ng.mu.Lock()
+		closed := ng.closed
+		ng.mu.Unlock()
+		if closed {
+			ng.idle <- nil
+			return
+		}
+
+		p, err := ng.start(id)
+		if err == nil {
+			metrics.IncrCounter([]string{"fn.worker.Restarts"}, 1)
+			ng.idle <- p
+			return
+		}
+		lg.Errorf("imgry worker %d failed to start: %s", id, err)
+
+		if wait > 10*time.Second {
+			wait = 10 * time.Second
+		}
+		time.Sleep(wait)
+	}
+}
+
+func (ng *Engine) start(id int) (*proc, error) {
+	jobsR, jobsW, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	resR, resW, err := os.Pipe()
+	if err != nil {
+		jobsR.Close()
+		jobsW.Close()
+		return nil, err
+	}
+
+	cmd := ng.Command()
+	cmd.ExtraFiles = []*os.File{jobsR, resW}
+	if cmd.Stdout == nil {
+		cmd.Stdout = os.Stderr
+	}
+	if cmd.Stderr == nil {
+		cmd.Stderr = os.Stderr
+	}
+
+	err = cmd.Start()
+
+	// The worker holds its own ends of the pipes
+	jobsR.Close()
+	resW.Close()
+
+	if err != nil {
+		jobsW.Close()
+		resR.Close()
+		return nil, err
+	}
+
+	p := &proc{
+		id:      id,
+		cmd:     cmd,
+		jobs:    jobsW,
+		results: resR,
+		enc:     gob.NewEncoder(jobsW),
+		dec:     gob.NewDecoder(resR),
+	}
+
+	var tmpDir string
+	if ng.tmpDir != "" {
+		tmpDir = filepath.Join(ng.tmpDir, fmt.Sprintf("worker-%d", id))
+	}
+	res, err := p.wait(context.Background(), p.send(&job{Op: opInit, TmpDir: tmpDir}), ng.deadline())
+	if err == nil {
+		err = res.err()
+	}
+	if err != nil {
+		p.kill()
+		return nil, err
+	}
+	p.version = res.Version
+	p.formats = res.Formats
+	p.text = res.Text
+
+	return p, nil
+}
+
+// proc is a running worker process.
+type proc struct {
+	id      int
+	cmd     *exec.Cmd
+	version string
+	formats []string
+	text    bool
+
+	jobs    *os.File
+	results *os.File
+	enc     *gob.Encoder
+	dec     *gob.Decoder
+}
+
+type reply struct {
+	res *result
+	err error
+}
+
+// send writes the job to the worker, its result is read in the background
+// and delivered on the returned channel.
+func (p *proc) send(j *job) <-chan reply {
+	replies := make(chan reply, 1)
+	go func() {
+		if err := p.enc.Encode(j); err != nil {
+			replies <- reply{nil, err}
+			return
+		}
+		var res result
+		err := p.dec.Decode(&res)
+		replies <- reply{&res, err}
+	}()
+	return replies
+}
+
+// wait returns the result of the job sent to the worker, unless the
+// deadline passes or the context is done first.
+func (p *proc) wait(ctx context.Context, replies <-chan reply, deadline time.Time) (*result, error) {
+	var expired <-chan time.Time
+	if !deadline.IsZero() {
+		t := time.NewTimer(deadline.Sub(time.Now()))
+		defer t.Stop()
+		expired = t.C
+	}
+
+	select {
+	case r := <-replies:
+		if r.err != nil || r.res.Fatal {
+			return nil, ErrWorkerCrashed
+		}
+		return r.res, nil
+	case <-expired:
+		return nil, ErrWorkerTimeout
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// stop closes the jobs pipe, letting the worker exit on its own.
+func (p *proc) stop() {
+	p.jobs.Close()
+	exited := make(chan struct{})
+	go func() {
+		p.cmd.Wait()
+		close(exited)
+	}()
+	select {
+	case <-exited:
+	case <-time.After(5 * time.Second):
+		p.cmd.Process.Kill()
+		<-exited
+	}
+	p.results.Close()
+}
+
+func (p *proc) kill() {
+	p.cmd.Process.Kill()
+	p.jobs.Close()
+	p.results.Close()
+	go p.cmd.Wait()
+}
+
+// Image is an image held by the parent as its encoded blob, every change
+// to it is made by a worker.
+type Image struct {
+	ng   *Engine
+	hint string
+
+	data     []byte
+	width    int
+	height   int
+	format   string
+	released bool
+}
+
+func (i *Image) Data() []byte {
+	return i.data
+}
+
+func (i *Image) Width() int {
+	return i.width
+}
+
+func (i *Image) Height() int {
+	return i.height
+}
+
+func (i *Image) Format() string {
+	return i.format
+}
+
+func (i *Image) SetFormat(format string) error {
+	sz := imgry.NewSizing()
+	sz.Quality = 0
+	sz.Format = format
+	return i.SizeIt(context.Background(), sz)
+}
+
+func (i *Image) Release() {
+	i.data = nil
+	i.released = true
+}
+
+func (i *Image) Released() bool {
+	return i.released
+}
+
+// Clone returns a copy of the image. Workers decode the blob for every
+// job, so a clone saves nothing over loading the blob again.
+func (i *Image) Clone() imgry.Image {
+	i2 := *i
+	return &i2
+}
+
+func (i *Image) SizeIt(ctx context.Context, sz *imgry.Sizing) error {
+	if i.Released() {
+		return ErrClosed
+	}
+
+	res, err := i.ng.do(ctx, &job{Op: opSize, Blob: i.data, Format: i.hint, Sizing: sz})
+	if err != nil {
+		return err
+	}
+	// Passed back like the engines in-process do
+	if sz.NeedsFocalPoint() {
+		sz.FocalPoint = res.FocalPoint
+	}
+	sz.DPR = res.DPR
+	i.data = res.Data
+	i.hint = res.Format
+	i.sync(res)
+	return nil
+}
+
+func (i *Image) WriteToFile(fn string) error {
+	return ioutil.WriteFile(fn, i.Data(), 0664)
+}
+
+func (i *Image) sync(res *result) {
+	i.width = res.Width
+	i.height = res.Height
+	i.format = res.Format
+}
@@ -0,0 +1,175 @@
+// Package worker runs an imgry.Engine in supervised subprocesses, so that a
+// crash, hang or OOM of the underlying image library only takes down a
+// single worker instead of the whole server.
+//
+// The parent and a worker talk over a pair of pipes, passed to the worker
+// as its file descriptors 3 (jobs) and 4 (results). Each job is answered
+// with exactly one result, both gob encoded.
+package worker
+
+import (
+	"context"
+	"encoding/gob"
+	"errors"
+	"io"
+	"os"
+
+	"github.com/pressly/imgry"
+)
+
+var (
+	ErrWorkerCrashed = errors.New("worker: image worker crashed")
+	ErrWorkerTimeout = errors.New("worker: image worker timed out")
+	ErrClosed        = errors.New("worker: engine is terminated")
+)
+
+const (
+	opInit = "init"
+	opLoad = "load"
+	opInfo = "info"
+	opSize = "size"
+)
+
+type job struct {
+	Op     string
+	TmpDir string
+
+	Blob   []byte
+	Format string // format hint of the blob
+
+	Sizing *imgry.Sizing
+}
+
+type result struct {
+	Version string
+	Formats []string
+	Text    bool // the engine draws text
+	Info    *imgry.ImageInfo
+
+	Data   []byte
+	Width  int
+	Height int
+	Format string
+
+	FocalPoint *imgry.FloatPoint // found by the engine while sizing
+	DPR        float64           // as resolved by the engine
+
+	Err     string
+	Invalid bool // the error is imgry.ErrInvalidImageData
+	Fatal   bool // the worker exits after this result
+}
+
+func (r *result) err() error {
+	switch {
+	case r.Fatal:
+		return ErrWorkerCrashed
+	case r.Invalid:
+		return imgry.ErrInvalidImageData
+	case r.Err != "":
+		return errors.New(r.Err)
+	default:
+		return nil
+	}
+}
+
+// Files returns the job and result pipes a worker process was started
+// with.
+func Files() (jobs io.ReadCloser, results io.WriteCloser) {
+	return os.NewFile(3, "imgry-jobs"), os.NewFile(4, "imgry-results")
+}
+
+// Serve runs the jobs read from r on the engine, writing their results to
+// w, until r is closed. The engine is initialized by the first job.
+// Errors listed in fatal are reported to the parent before Serve returns
+// them, the worker is expected to exit and be restarted fresh.
+func Serve(ng imgry.Engine, r io.Reader, w io.Writer, fatal ...error) error {
+	dec := gob.NewDecoder(r)
+	enc := gob.NewEncoder(w)
+
+	initialized := false
+	defer func() {
+		if initialized {
+			ng.Terminate()
+		}
+	}()
+
+	for {
+		var j job
+		if err := dec.Decode(&j); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+
+		res, err := run(ng, &j)
+		if j.Op == opInit && err == nil {
+			initialized = true
+		}
+		if err != nil {
+			res = &result{Err: err.Error(), Invalid: err == imgry.ErrInvalidImageData}
+			for _, ferr := range fatal {
+				if err == ferr {
+					res.Fatal = true
+				}
+			}
+		}
+
+		if werr := enc.Encode(res); werr != nil {
+			return werr
+		}
+		if res.Fatal {
+			return err
+		}
+	}
+}
+
+func run(ng imgry.Engine, j *job) (*result, error) {
+	// The parent lets a job run to its end when the request is canceled,
+	// there's nothing to cancel from here.
+	ctx := context.Background()
+
+	switch j.Op {
+	case opInit:
+		if err := ng.Initialize(j.TmpDir); err != nil {
+			return nil, err
+		}
+		return &result{Version: ng.Version(), Formats: ng.Formats(), Text: imgry.DrawsText(ng)}, nil
+
+	case opInfo:
+		imfo, err := ng.GetImageInfo(j.Blob, j.Format)
+		if err != nil {
+			return nil, err
+		}
+		return &result{Info: imfo}, nil
+	}
+
+	im, err := ng.LoadBlob(ctx, j.Blob, j.Format)
+	if err != nil {
+		return nil, err
+	}
+	defer im.Release()
+
+	switch j.Op {
+	case opLoad:
+		// The source blob is still the data of the image, the parent
+		// already has it.
+		return &result{Width: im.Width(), Height: im.Height(), Format: im.Format()}, nil
+
+	case opSize:
+		if err := im.SizeIt(ctx, j.Sizing); err != nil {
+			return nil, err
+		}
+		return &result{
+			Data:       im.Data(),
+			Width:      im.Width(),
+			Height:     im.Height(),
+			Format:     im.Format(),
+			FocalPoint: j.Sizing.FocalPoint,
+			DPR:        j.Sizing.DPR,
+		}, nil
+
+	default:
+		return nil, errors.New("worker: unknown job " + j.Op)
+	}
+}
@@ -0,0 +1,155 @@
+package worker
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/pressly/imgry"
+	"github.com/pressly/imgry/imagex"
+	"github.com/stretchr/testify/assert"
+)
+
+// The test binary doubles as the worker process
+func TestMain(m *testing.M) {
+	if os.Getenv("IMGRY_TEST_WORKER") != "" {
+		jobs, results := Files()
+		if err := Serve(crashEngine{}, jobs, results); err != nil {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// crashEngine is the imagex engine, except it crashes, hangs or takes its
+// time on demand
+type crashEngine struct {
+	imagex.Engine
+}
+
+func (ng crashEngine) LoadBlob(ctx context.Context, b []byte, srcFormat ...string) (imgry.Image, error) {
+	switch string(b) {
+	case "crash":
+		os.Exit(2)
+	case "hang":
+		time.Sleep(time.Hour)
+	case "slow":
+		time.Sleep(300 * time.Millisecond)
+	}
+	return ng.Engine.LoadBlob(ctx, b, srcFormat...)
+}
+
+func newTestEngine(t *testing.T, timeout time.Duration) *Engine {
+	ng := New(1, timeout, func() *exec.Cmd {
+		cmd := exec.Command(os.Args[0])
+		cmd.Env = append(os.Environ(), "IMGRY_TEST_WORKER=1")
+		return cmd
+	})
+	err := ng.Initialize("")
+	assert.NoError(t, err)
+	return ng
+}
+
+func TestSizeIt(t *testing.T) {
+	ng := newTestEngine(t, 0)
+	defer ng.Terminate()
+
+	img, err := ng.LoadFile("../testdata/image1.jpg")
+	assert.NoError(t, err)
+	defer img.Release()
+
+	assert.Equal(t, 1600, img.Width())
+	assert.Equal(t, "jpg", img.Format())
+
+	// The formats of the engine in the workers, and whether it draws text
+	assert.Equal(t, imagex.Engine{}.Formats(), ng.Formats())
+	assert.Equal(t, imgry.DrawsText(imagex.Engine{}), ng.DrawsText())
+
+	sz, _ := imgry.NewSizingFromQuery("size=400x&format=png")
+	err = img.SizeIt(context.Background(), sz)
+	assert.NoError(t, err)
+
+	assert.Equal(t, 400, img.Width())
+	assert.Equal(t, 300, img.Height())
+	assert.Equal(t, "png", img.Format())
+
+	imfo, err := ng.GetImageInfo(img.Data())
+	assert.NoError(t, err)
+	assert.Equal(t, 400, imfo.Width)
+	assert.Equal(t, "png", imfo.Format)
+
+	// The focal point found by the worker makes it back
+	sz, _ = imgry.NewSizingFromQuery("size=100x100&op=smart")
+	err = img.SizeIt(context.Background(), sz)
+	assert.NoError(t, err)
+	assert.Equal(t, 100, img.Width())
+	assert.NotNil(t, sz.FocalPoint)
+
+	// So does the DPR it lowered to the source
+	img2, err := ng.LoadFile("../testdata/image1.jpg")
+	assert.NoError(t, err)
+	defer img2.Release()
+	sz, _ = imgry.NewSizingFromQuery("size=1000x&dpr=2&g=1")
+	err = img2.SizeIt(context.Background(), sz)
+	assert.NoError(t, err)
+	assert.Equal(t, 1.6, sz.DPR)
+	assert.Equal(t, 1600, img2.Width())
+
+	_, err = ng.LoadBlob(context.Background(), []byte("not an image"))
+	assert.Equal(t, imgry.ErrInvalidImageData, err)
+}
+
+func TestWorkerRestart(t *testing.T) {
+	ng := newTestEngine(t, time.Second)
+	defer ng.Terminate()
+
+	tdImage1, err := ioutil.ReadFile("../testdata/gophers.png")
+	assert.NoError(t, err)
+
+	_, err = ng.LoadBlob(context.Background(), []byte("crash"))
+	assert.Equal(t, ErrWorkerCrashed, err)
+
+	// The worker is replaced in the background
+	img, err := ng.LoadBlob(context.Background(), tdImage1)
+	assert.NoError(t, err)
+	assert.Equal(t, "png", img.Format())
+
+	_, err = ng.LoadBlob(context.Background(), []byte("hang"))
+	assert.Equal(t, ErrWorkerTimeout, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = ng.LoadBlob(ctx, []byte("hang"))
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	img, err = ng.LoadBlob(context.Background(), tdImage1)
+	assert.NoError(t, err)
+	assert.Equal(t, "png", img.Format())
+}
+
+func TestWorkerCancel(t *testing.T) {
+	ng := newTestEngine(t, 5*time.Second)
+	defer ng.Terminate()
+
+	p := <-ng.idle
+	pid := p.cmd.Process.Pid
+	ng.idle <- p
+
+	// The request goes away, the worker finishes its job all the same
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := ng.LoadBlob(ctx, []byte("slow"))
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	img, err := ng.LoadFile("../testdata/gophers.png")
+	assert.NoError(t, err)
+	assert.Equal(t, "png", img.Format())
+
+	p = <-ng.idle
+	assert.Equal(t, pid, p.cmd.Process.Pid, "the worker was restarted")
+	ng.idle <- p
+}